@@ -17,244 +17,557 @@ tort or otherwise, arising from, out of or in connection with the software or th
 package main
 
 import (
+	"archive/zip"
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode/utf8"
 )
 
 const version = "1.0.3"
 
 type Stream struct {
-	URL        string `json:"url"`
-	TvgName    string `json:"tvg_name"`
-	GroupTitle string `json:"group_title"`
+	URL        string     `json:"url"`
+	TvgName    string     `json:"tvg_name"`
+	GroupTitle string     `json:"group_title"`
+	SeriesName string     `json:"series_name,omitempty"`
+	Season     int        `json:"season,omitempty"`
+	Episode    int        `json:"episode,omitempty"`
+	Extension  string     `json:"container_extension,omitempty"`
+	TvgID      string     `json:"tvg_id,omitempty"`
+	TvgLogo    string     `json:"tvg_logo,omitempty"`
+	Plot       string     `json:"plot,omitempty"`
+	Rating     flexString `json:"rating,omitempty"`
+	Year       flexString `json:"year,omitempty"`
+
+	Attributes map[string]string `json:"attributes,omitempty"` // all EXTINF attributes
+	Options    []string          `json:"options,omitempty"`    // #EXTVLCOPT and #KODIPROP lines
+
+	SeriesPlot   string `json:"series_plot,omitempty"`
+	SeriesPoster string `json:"series_poster,omitempty"`
+
+	// Tags parsed from the tvg-name by setMediaTags
+	Quality   string   `json:"-"` // 4K, 1080p, 720p or SD
+	Codec     string   `json:"-"` // HEVC, H264 or AV1
+	Languages []string `json:"-"` // language and subtitle tags such as MULTI-SUB or VOSTFR
+	Version   string   `json:"-"` // label of this copy when several versions of a title are kept
+
+	Source string `json:"-"` // Source URL the stream was read from
+}
+
+type MediaServer struct {
+	Type       string            `json:"type"` // emby or jellyfin
+	URL        string            `json:"url"`
+	APIKey     string            `json:"apiKey"`
+	LibraryIDs []string          `json:"libraryIds"`
+	PathMap    map[string]string `json:"pathMap"` // local path prefix -> path seen by the server
+}
+
+// Library is an extra output root. Streams matching any of its rules are
+// written below Dir instead of tvShowsDir or moviesDir, the first library
+// matching wins.
+type Library struct {
+	Name            string       `json:"name"`
+	Dir             string       `json:"dir"`
+	Match           []FilterRule `json:"match"`           // field and glob or regex, action is not used
+	Type            string       `json:"type"`            // movies, tvshows or auto (default: auto)
+	MovieTemplate   string       `json:"movieTemplate"`   // default: the naming style layout
+	EpisodeTemplate string       `json:"episodeTemplate"` // default: the naming style layout
+	Prune           *int         `json:"prune"`           // 0 to never remove .strm files from Dir (default: 1)
+
+	movieTemplate   *template.Template
+	episodeTemplate *template.Template
+}
+
+// Library types
+const (
+	libraryAuto    = "auto"    // episodes and movies told apart by name
+	libraryMovies  = "movies"  // every stream is named as a movie
+	libraryTVShows = "tvshows" // every stream is named as an episode, a special when it has no number
+)
+
+// LiveTV writes the live channels of the M3U sources, the streams fileType
+// rejects, to a playlist for the Jellyfin/Emby Live TV tuner.
+type LiveTV struct {
+	Output        string       `json:"output"`        // path of the playlist to write
+	FileType      string       `json:"fileType"`      // live stream types (default: ts,m3u8), * for every rejected stream
+	Filters       []FilterRule `json:"filters"`       // same rules as the filters block
+	FilterDefault string       `json:"filterDefault"` // include or exclude
+	StartNumber   int          `json:"startNumber"`   // first channel number (default: 1)
+	KeepNumbers   int          `json:"keepNumbers"`   // 1 to keep the tvg-chno of the provider
+
+	EPGURLs      []string `json:"epgURLs"`      // XMLTV guides, gzip is detected
+	EPGOutput    string   `json:"epgOutput"`    // default: output with a .xml extension
+	EPGDays      int      `json:"epgDays"`      // days of programmes ahead kept (default: 3)
+	EPGPastHours int      `json:"epgPastHours"` // hours of past programmes kept for catch-up (default: 6)
+
+	fileTypes      []string
+	rules          []FilterRule
+	defaultInclude bool
+}
+
+// HTTPOptions controls how sources are downloaded. The http block applies to
+// every source, sourceHttp entries override it for sources starting with
+// their key.
+type HTTPOptions struct {
+	Timeout   string            `json:"timeout,omitempty"` // e.g. 60s, for connecting and for each read
+	Retries   *int              `json:"retries,omitempty"`
+	UserAgent string            `json:"userAgent,omitempty"`
+	Proxy     string            `json:"proxy,omitempty"` // http://, https:// or socks5:// URL
+	Headers   map[string]string `json:"headers,omitempty"`
+}
+
+type XtreamSource struct {
+	Host     string `json:"host"`
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 type Config struct {
-	Name           string   `json:"name"`
-	LogLevel       int      `json:"logLevel"`
-	TvShowsDir     string   `json:"tvShowsDir"`
-	MoviesDir      string   `json:"moviesDir"`
-	JsonURLs       []string `json:"jsonURLs"`
-	M3UURLs        []string `json:"m3uURLs"`
-	LogFile        string   `json:"logFile"`
-	FileType       string   `json:"fileType"`
-	WorkingDir     string   `json:"workingDir"`
-	LogDir         string   `json:"logDir"`
-	RetainDownload int      `json:"retainDownload"`
-	DownloadDir    string   `json:"downloadDir"`
-	LimitDelete    int      `json:"limitDelete"`
-	UseGroup       int      `json:"useGroup"`
-	DefaultGroup   string   `json:"defaultGroup"`
-	ExcludeGroup   string   `json:"excludeGroup"`
-	IncludeGroup   string   `json:"includeGroup"`
+	Name            string   `json:"name"`
+	LogLevel        int      `json:"logLevel"`
+	TvShowsDir      string   `json:"tvShowsDir"`
+	MoviesDir       string   `json:"moviesDir"`
+	JsonURLs        []string `json:"jsonURLs"`
+	M3UURLs         []string `json:"m3uURLs"`
+	LogFile         string   `json:"logFile"`
+	FileType        string   `json:"fileType"`
+	WorkingDir      string   `json:"workingDir"`
+	LogDir          string   `json:"logDir"`
+	RetainDownload  int      `json:"retainDownload"`
+	DownloadDir     string   `json:"downloadDir"`
+	LimitDelete     int      `json:"limitDelete"`
+	UseGroup        int      `json:"useGroup"`
+	DefaultGroup    string   `json:"defaultGroup"`
+	ExcludeGroup    string   `json:"excludeGroup"`
+	IncludeGroup    string   `json:"includeGroup"`
+	AdoptExisting   int      `json:"adoptExisting"`
+	WriteNfo        int      `json:"writeNfo"`
+	DownloadPosters int      `json:"downloadPosters"`
+	Naming          string   `json:"naming"`
+	MovieTemplate   string   `json:"movieTemplate"`
+	EpisodeTemplate string   `json:"episodeTemplate"`
+	StripPrefixes   string   `json:"stripPrefixes"`
+	Interval        string   `json:"interval"`
+	Schedule        string   `json:"schedule"`
+	Jitter          string   `json:"jitter"`
+	LogKeep         int      `json:"logKeep"`
+	TrashDays       int      `json:"trashDays"`
+	MaxDropPercent  int      `json:"maxDropPercent"`
+	MinStreams      *int     `json:"minStreams"`
+	SkipUnchanged   int      `json:"skipUnchanged"`
+
+	Filters       []FilterRule `json:"filters"`
+	FilterDefault string       `json:"filterDefault"`
+
+	KeepDuplicates int      `json:"keepDuplicates"`
+	DedupePrefer   []string `json:"dedupePrefer"`
+	GroupPriority  []string `json:"groupPriority"`
+	MovieVersions  string   `json:"movieVersions"`
+
+	EpisodeMatchers []string `json:"episodeMatchers"`
+
+	Libraries []Library `json:"libraries"`
+	LiveTV    *LiveTV   `json:"liveTV"`
+
+	XtreamSources []XtreamSource         `json:"xtreamSources"`
+	MediaServers  []MediaServer          `json:"mediaServers"`
+	HTTP          HTTPOptions            `json:"http"`
+	SourceHTTP    map[string]HTTPOptions `json:"sourceHttp"`
 }
 
 var (
-	name             string
-	logLevel         int
-	tvShowsDir       string
-	moviesDir        string
-	jsonURLs         []string
-	m3uURLs          []string
-	logFile          string
-	fileTypes        []string
-	workingDir       string
-	logDir           string
-	createdDirs      int
-	keptStrmFiles    int
-	removedStrmFiles int
-	removedEmptyDirs int
-	logFileHandle    *os.File
-	downloadDir      string
-	useGroup         int
-	defaultGroup     string
-	excludeGroups    []string
-	includeGroups    []string
-	keepFiles        map[string]bool // Declare keepFiles here
+	name                 string
+	logLevel             int
+	tvShowsDir           string
+	moviesDir            string
+	jsonURLs             []string
+	m3uURLs              []string
+	xtreamSources        []XtreamSource
+	logFile              string
+	fileTypes            []string
+	workingDir           string
+	logDir               string
+	createdDirs          int
+	keptStrmFiles        int
+	removedStrmFiles     int
+	removedEmptyDirs     int
+	logFileHandle        *os.File
+	downloadDir          string
+	useGroup             int
+	defaultGroup         string
+	excludeGroups        []string
+	includeGroups        []string
+	filterRules          []FilterRule
+	filterDefaultInclude bool
+	keepDuplicates       int
+	dedupePrefer         []string
+	groupPriority        []*regexp.Regexp
+	movieVersions        string
+	episodeMatchers      []episodeMatcher
+	libraries            []Library
+	liveTV               *LiveTV
+	liveStreams          []Stream        // live channels collected while parsing
+	keepFiles            map[string]bool // Declare keepFiles here
+	manifest             *Manifest
+	namingStyle          string
+	writeNfo             int
+	downloadPosters      int
+	movieTemplate        *template.Template
+	episodeTemplate      *template.Template
+	stripPrefixes        []string
+	dryRun               bool
+	plan                 *Plan
+	httpOptions          HTTPOptions
+	retainDownload       int
+	skipUnchanged        int
+	forcePrune           bool
+	trash                *Trash
+	sourceCache          *SourceCache
+	sourceHTTP           map[string]HTTPOptions
+	xtreamShowsOnly      bool // list each Xtream series once, without fetching its episodes
 )
 
-func main() {
-	// Command line arguments
-	configFile := flag.String("config", "", "Path to the configuration file")
-	nameFlag := flag.String("name", "", "Name to be printed in the log file and used for config file creation")
-	logLevelFlag := flag.Int("logLevel", -1, "Log level: 0 = silent, 1 = basic information, 3 = all debug and errors")
-	tvShowsDirFlag := flag.String("tvShowsDir", "", "Directory for TV shows")
-	moviesDirFlag := flag.String("moviesDir", "", "Directory for movies")
-	jsonURLFlag := flag.String("jsonURL", "", "URL of the JSON file")
-	m3uURLFlag := flag.String("m3u", "", "URL of the M3U file")
-	logFileFlag := flag.String("logFile", "", "Name of the log file")
-	fileTypeFlag := flag.String("fileType", "avi,flv,m4v,mkv,mkv2,mkv5,mkvv,mp4,mp41,mp42,mp44,mpg,wmv", "Comma separated list of valid strm file types")
-	workingDirFlag := flag.String("workingDir", "", "Working directory")
-	logDirFlag := flag.String("logDir", "", "Directory for log files")
-	helpFlag := flag.Bool("help", false, "Show help message")
-	retainDownloadFlag := flag.Int("retainDownload", 0, "Set to 1 to keep downloaded files, 0 to delete (default: 0)")
-	downloadDirFlag := flag.String("downloadDir", "", "Directory to keep downloaded files (overrides default)")
-	limitDeleteFlag := flag.Int("limitDelete", 25, "Maximum number of .strm files to delete (default: 25)")
-	useGroupFlag := flag.Int("useGroup", 0, "Set to 1 to use group title in directory structure, 0 to not use (default: 0)")
-	defaultGroupFlag := flag.String("defaultGroup", "Dummy", "Default group title if useGroup is set and group is not specified (default: Dummy)")
-
-	excludeGroupFlag := flag.String("excludeGroup", "", "Comma separated list of groups to exclude")
-	includeGroupFlag := flag.String("includeGroup", "", "Comma separated list of groups to include")
-
-	versionFlag := flag.Bool("version", false, "Display the version information")
+// Exit codes shared by every command
+const (
+	exitOK     = 0
+	exitFailed = 1 // the run or a source failed
+	exitUsage  = 2 // invalid command line or configuration
+)
 
-	stats := map[string]int{
-		"createdDirs":       0,
-		"keptStrmFiles":     0,
-		"removedStrmFiles":  0,
-		"removedEmptyDirs":  0,
-		"processedJsonURLs": 0,
-		"processedM3UURLs":  0,
-		"rejectedFileExts":  0,
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 {
+		showHelp()
+		os.Exit(exitUsage)
 	}
 
-	flag.Parse()
-
-	if *versionFlag {
-		fmt.Printf("GetSTRM version %s\n", version)
-		// Print copyright notice
-		fmt.Println("Copyright (c) 2024 Jules Potvin")
-		fmt.Println("Licensed under the Creative Commons Attribution-NonCommercial 4.0 International License")
-		fmt.Println("http://creativecommons.org/licenses/by-nc/4.0/")
-		fmt.Println()
-		return
+	// Options without a command run a sync, as before commands existed
+	command := "sync"
+	if !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
 	}
 
-	if *helpFlag {
+	switch command {
+	case "sync":
+		os.Exit(runSyncCommand(args, false))
+	case "plan":
+		os.Exit(runSyncCommand(args, true))
+	case "validate-config":
+		os.Exit(runValidateCommand(args))
+	case "groups":
+		os.Exit(runGroupsCommand(args))
+	case "init":
+		os.Exit(runInitCommand(args))
+	case "restore":
+		os.Exit(runRestore(args))
+	case "version":
+		printVersion()
+	case "help":
 		showHelp()
-		return
+	default:
+		fmt.Printf("Error: unknown command %q\n", command)
+		showHelp()
+		os.Exit(exitUsage)
+	}
+}
+
+func printVersion() {
+	fmt.Printf("GetSTRM version %s\n", version)
+	// Print copyright notice
+	fmt.Println("Copyright (c) 2024 Jules Potvin")
+	fmt.Println("Licensed under the Creative Commons Attribution-NonCommercial 4.0 International License")
+	fmt.Println("http://creativecommons.org/licenses/by-nc/4.0/")
+	fmt.Println()
+}
+
+// configFlags are the command line options that override the configuration
+// file. Every command reading a configuration accepts them.
+type configFlags struct {
+	configFile      *string
+	name            *string
+	logLevel        *int
+	tvShowsDir      *string
+	moviesDir       *string
+	jsonURL         *string
+	m3uURL          *string
+	logFile         *string
+	fileType        *string
+	workingDir      *string
+	logDir          *string
+	retainDownload  *int
+	downloadDir     *string
+	skipUnchanged   *int
+	keepDuplicates  *int
+	movieVersions   *string
+	limitDelete     *int
+	useGroup        *int
+	defaultGroup    *string
+	excludeGroup    *string
+	includeGroup    *string
+	writeNfo        *int
+	downloadPosters *int
+	naming          *string
+	movieTemplate   *string
+	episodeTemplate *string
+	stripPrefixes   *string
+	maxDropPercent  *int
+	minStreams      *int
+	adoptExisting   *int
+	interval        *string
+	schedule        *string
+	jitter          *string
+	trashDays       *int
+	logKeep         *int
+	timeout         *string
+	retries         *int
+	userAgent       *string
+	proxy           *string
+}
+
+func addConfigFlags(flags *flag.FlagSet) *configFlags {
+	return &configFlags{
+		configFile:      flags.String("config", "", "Path to the configuration file"),
+		name:            flags.String("name", "", "Name to be printed in the log file and used for config file creation"),
+		logLevel:        flags.Int("logLevel", -1, "Log level: 0 = silent, 1 = basic information, 3 = all debug and errors"),
+		tvShowsDir:      flags.String("tvShowsDir", "", "Directory for TV shows"),
+		moviesDir:       flags.String("moviesDir", "", "Directory for movies"),
+		jsonURL:         flags.String("jsonURL", "", "URL or path of the JSON file, - for stdin"),
+		m3uURL:          flags.String("m3u", "", "URL or path of the M3U file, - for stdin"),
+		logFile:         flags.String("logFile", "", "Name of the log file"),
+		fileType:        flags.String("fileType", "avi,flv,m4v,mkv,mkv2,mkv5,mkvv,mp4,mp41,mp42,mp44,mpg,wmv", "Comma separated list of valid strm file types"),
+		workingDir:      flags.String("workingDir", "", "Working directory"),
+		logDir:          flags.String("logDir", "", "Directory for log files"),
+		retainDownload:  flags.Int("retainDownload", 0, "Set to 1 to keep downloaded files, 0 to delete (default: 0)"),
+		downloadDir:     flags.String("downloadDir", "", "Directory to keep downloaded files (overrides default)"),
+		keepDuplicates:  flags.Int("keepDuplicates", 0, "Set to 1 to write every copy of a title listed in several groups or sources (default: 0)"),
+		movieVersions:   flags.String("movieVersions", "", "best to keep the best copy of a movie, all to keep one file per quality (default: best)"),
+		skipUnchanged:   flags.Int("skipUnchanged", 0, "Set to 1 to skip the run when no source changed since the last run (default: 0)"),
+		limitDelete:     flags.Int("limitDelete", 25, "Maximum number of .strm files to delete (default: 25)"),
+		useGroup:        flags.Int("useGroup", 0, "Set to 1 to use group title in directory structure, 0 to not use (default: 0)"),
+		defaultGroup:    flags.String("defaultGroup", "Dummy", "Default group title if useGroup is set and group is not specified (default: Dummy)"),
+		excludeGroup:    flags.String("excludeGroup", "", "Comma separated list of groups to exclude"),
+		includeGroup:    flags.String("includeGroup", "", "Comma separated list of groups to include"),
+		writeNfo:        flags.Int("writeNfo", 0, "Set to 1 to write movie.nfo, tvshow.nfo and episode .nfo files (default: 0)"),
+		downloadPosters: flags.Int("downloadPosters", 0, "Set to 1 to download posters as folder.jpg when writeNfo is set (default: 0)"),
+		naming:          flags.String("naming", "", "Naming style: legacy or jellyfin (default: legacy)"),
+		movieTemplate:   flags.String("movieTemplate", "", "Go template for movie paths below moviesDir, e.g. \"{{first .Title}}/{{.Title}}/{{.Title}}\""),
+		episodeTemplate: flags.String("episodeTemplate", "", "Go template for episode paths below tvShowsDir"),
+		stripPrefixes:   flags.String("stripPrefixes", "", "Comma separated list of extra title prefixes to remove with jellyfin naming"),
+		maxDropPercent:  flags.Int("maxDropPercent", 0, "Skip pruning when a source lists this percentage fewer streams than last run (default: 50)"),
+		minStreams:      flags.Int("minStreams", -1, "Skip pruning when a source lists fewer streams than this (default: 1, 0 to disable)"),
+		adoptExisting:   flags.Int("adoptExisting", 0, "Set to 1 to take ownership of existing .strm files when no manifest exists yet (default: 0)"),
+		interval:        flags.String("interval", "", "Time between daemon runs, e.g. 6h or 90m"),
+		schedule:        flags.String("schedule", "", "Cron expression for daemon runs, e.g. \"0 */4 * * *\""),
+		jitter:          flags.String("jitter", "", "Random delay added to each daemon run, e.g. 10m"),
+		trashDays:       flags.Int("trashDays", 0, "Days to keep removed .strm files in the trash, -1 to delete them at once (default: 30)"),
+		logKeep:         flags.Int("logKeep", 0, "Number of rotated log files to keep in daemon mode (default: 7)"),
+		timeout:         flags.String("timeout", "", "Download timeout for connecting and for each read, e.g. 60s (default: 60s)"),
+		retries:         flags.Int("retries", -1, "Number of retries for failed downloads (default: 3)"),
+		userAgent:       flags.String("userAgent", "", "User-Agent sent to providers (default: Chrome)"),
+		proxy:           flags.String("proxy", "", "HTTP or SOCKS5 proxy URL, e.g. socks5://127.0.0.1:1080"),
 	}
+}
 
+// load reads the configuration file, if one was given, and applies the
+// command line overrides.
+func (f *configFlags) load() (*Config, error) {
 	// Load configuration from file if provided
-	var config *Config
-	var err error
-	if *configFile != "" {
-		config, err = loadConfig(*configFile)
+	config := &Config{}
+	if *f.configFile != "" {
+		var err error
+		config, err = loadConfig(*f.configFile)
 		if err != nil {
-			fmt.Println("Error loading config file:", err)
-			return
+			return nil, fmt.Errorf("error loading config file: %v", err)
 		}
-	} else {
-		config = &Config{}
 	}
 
 	// Override config with command line parameters if provided
-	if *nameFlag != "" {
-		config.Name = *nameFlag
+	if *f.name != "" {
+		config.Name = *f.name
 	}
-	if *logLevelFlag != -1 {
-		config.LogLevel = *logLevelFlag
+	if *f.logLevel != -1 {
+		config.LogLevel = *f.logLevel
 	}
-	if *tvShowsDirFlag != "" {
-		config.TvShowsDir = *tvShowsDirFlag
+	if *f.tvShowsDir != "" {
+		config.TvShowsDir = *f.tvShowsDir
 	}
-	if *moviesDirFlag != "" {
-		config.MoviesDir = *moviesDirFlag
+	if *f.moviesDir != "" {
+		config.MoviesDir = *f.moviesDir
 	}
-	if *jsonURLFlag != "" {
-		config.JsonURLs = append(config.JsonURLs, *jsonURLFlag)
+	if *f.jsonURL != "" {
+		config.JsonURLs = append(config.JsonURLs, *f.jsonURL)
 	}
-	if *m3uURLFlag != "" {
-		config.M3UURLs = append(config.M3UURLs, *m3uURLFlag)
+	if *f.m3uURL != "" {
+		config.M3UURLs = append(config.M3UURLs, *f.m3uURL)
 	}
-	if *logFileFlag != "" {
-		config.LogFile = *logFileFlag
+	if *f.logFile != "" {
+		config.LogFile = *f.logFile
 		if strings.ContainsAny(config.LogFile, `/\`) {
-			fmt.Println("Error: logFile should be a file name only, not a path.")
-			return
+			return nil, fmt.Errorf("logFile should be a file name only, not a path")
 		}
 	}
-	if *fileTypeFlag != "" {
-		config.FileType = *fileTypeFlag
+	if *f.fileType != "" {
+		config.FileType = *f.fileType
 	}
-	if *workingDirFlag != "" {
-		config.WorkingDir = *workingDirFlag
-	} else {
-		workingDir, _ = os.Getwd() // Default to current working directory
+	if *f.workingDir != "" {
+		config.WorkingDir = *f.workingDir
+	}
+	if *f.logDir != "" {
+		config.LogDir = *f.logDir
+	}
+	if *f.retainDownload != 0 {
+		config.RetainDownload = *f.retainDownload
+	}
+	if *f.downloadDir != "" {
+		config.DownloadDir = *f.downloadDir
+	}
+	if *f.keepDuplicates != 0 {
+		config.KeepDuplicates = *f.keepDuplicates
+	}
+	if *f.movieVersions != "" {
+		config.MovieVersions = *f.movieVersions
+	}
+	if *f.skipUnchanged != 0 {
+		config.SkipUnchanged = *f.skipUnchanged
+	}
+	if *f.limitDelete != 25 {
+		config.LimitDelete = *f.limitDelete
+	}
+	if *f.useGroup != 0 {
+		config.UseGroup = *f.useGroup
 	}
-	if *logDirFlag != "" {
-		config.LogDir = *logDirFlag
+	if *f.defaultGroup != "Dummy" {
+		config.DefaultGroup = *f.defaultGroup
 	}
-	if *retainDownloadFlag != 0 {
-		config.RetainDownload = *retainDownloadFlag
+	if *f.excludeGroup != "" {
+		config.ExcludeGroup = *f.excludeGroup
 	}
-	if *downloadDirFlag != "" {
-		config.DownloadDir = *downloadDirFlag
+	if *f.includeGroup != "" {
+		config.IncludeGroup = *f.includeGroup
 	}
-	if *limitDeleteFlag != 25 {
-		config.LimitDelete = *limitDeleteFlag
+	if *f.writeNfo != 0 {
+		config.WriteNfo = *f.writeNfo
 	}
-	if *useGroupFlag != 0 {
-		config.UseGroup = *useGroupFlag
+	if *f.downloadPosters != 0 {
+		config.DownloadPosters = *f.downloadPosters
 	}
-	if *defaultGroupFlag != "Dummy" {
-		config.DefaultGroup = *defaultGroupFlag
+	if *f.naming != "" {
+		config.Naming = *f.naming
 	}
-	if *excludeGroupFlag != "" {
-		config.ExcludeGroup = *excludeGroupFlag
+	if *f.movieTemplate != "" {
+		config.MovieTemplate = *f.movieTemplate
 	}
-	if *includeGroupFlag != "" {
-		config.IncludeGroup = *includeGroupFlag
+	if *f.episodeTemplate != "" {
+		config.EpisodeTemplate = *f.episodeTemplate
 	}
+	if *f.stripPrefixes != "" {
+		config.StripPrefixes = *f.stripPrefixes
+	}
+	if *f.maxDropPercent != 0 {
+		config.MaxDropPercent = *f.maxDropPercent
+	}
+	if *f.minStreams != -1 {
+		config.MinStreams = f.minStreams
+	}
+	if *f.adoptExisting != 0 {
+		config.AdoptExisting = *f.adoptExisting
+	}
+	if *f.interval != "" {
+		config.Interval = *f.interval
+	}
+	if *f.schedule != "" {
+		config.Schedule = *f.schedule
+	}
+	if *f.jitter != "" {
+		config.Jitter = *f.jitter
+	}
+	if *f.trashDays != 0 {
+		config.TrashDays = *f.trashDays
+	}
+	if *f.logKeep != 0 {
+		config.LogKeep = *f.logKeep
+	}
+	if *f.timeout != "" {
+		config.HTTP.Timeout = *f.timeout
+	}
+	if *f.retries != -1 {
+		config.HTTP.Retries = f.retries
+	}
+	if *f.userAgent != "" {
+		config.HTTP.UserAgent = *f.userAgent
+	}
+	if *f.proxy != "" {
+		config.HTTP.Proxy = *f.proxy
+	}
+	return config, nil
+}
 
+// applyConfig validates config and sets the globals the run uses. It does
+// not touch the disk, output directories are only required when needOutput
+// is set.
+func applyConfig(config *Config, needOutput bool) error {
 	// Ensure all required parameters are set
 	missingParams := []string{}
-	if config.TvShowsDir == "" {
+	if needOutput && config.TvShowsDir == "" {
 		missingParams = append(missingParams, "tvShowsDir")
 	}
-	if config.MoviesDir == "" {
+	if needOutput && config.MoviesDir == "" {
 		missingParams = append(missingParams, "moviesDir")
 	}
-	if len(config.JsonURLs) == 0 && len(config.M3UURLs) == 0 {
-		missingParams = append(missingParams, "jsonURL or m3u")
-	}
-	if config.WorkingDir != "" {
-		workingDir = config.WorkingDir
+	if len(config.JsonURLs) == 0 && len(config.M3UURLs) == 0 && len(config.XtreamSources) == 0 {
+		missingParams = append(missingParams, "jsonURL, m3u or xtreamSources")
 	}
-
 	if len(missingParams) > 0 {
-		fmt.Printf("Error: Missing required parameters: %s\n", strings.Join(missingParams, ", "))
-		showHelp()
-		return
+		return fmt.Errorf("missing required parameters: %s", strings.Join(missingParams, ", "))
 	}
 
 	// Validate working directory
+	workingDir = config.WorkingDir
+	if workingDir == "" {
+		workingDir, _ = os.Getwd() // Default to current working directory
+	}
 	if _, err := os.Stat(workingDir); os.IsNotExist(err) {
-		fmt.Printf("Error: Working directory does not exist: %s\n", workingDir)
-		return
+		return fmt.Errorf("working directory does not exist: %s", workingDir)
 	}
 
-	// Set logDir if not provided
+	// Set logDir and downloadDir if not provided
 	if config.LogDir == "" {
 		config.LogDir = filepath.Join(workingDir, "Log")
 	}
-
-	// Create log directory if it does not exist
-	if _, err := os.Stat(config.LogDir); os.IsNotExist(err) {
-		os.MkdirAll(config.LogDir, os.ModePerm)
-		fmt.Println("Created log directory:", config.LogDir)
-	}
-
-	// Set downloadDir and downloadDir
-	if config.DownloadDir != "" {
-		downloadDir = config.DownloadDir
-	} else {
+	downloadDir = config.DownloadDir
+	if downloadDir == "" {
 		downloadDir = filepath.Join(workingDir, "Download")
-		if _, err := os.Stat(downloadDir); os.IsNotExist(err) {
-			os.MkdirAll(downloadDir, os.ModePerm)
-			fmt.Println("Created directory:", downloadDir)
-		}
 	}
 
 	// Set configuration variables
@@ -264,99 +577,222 @@ func main() {
 	moviesDir = config.MoviesDir
 	jsonURLs = config.JsonURLs
 	m3uURLs = config.M3UURLs
+	xtreamSources = config.XtreamSources
 	fileTypes = strings.Split(config.FileType, ",")
 	logDir = config.LogDir
 	useGroup = config.UseGroup
+	retainDownload = config.RetainDownload
+	skipUnchanged = config.SkipUnchanged
+	writeNfo = config.WriteNfo
+	downloadPosters = config.DownloadPosters
 	defaultGroup = config.DefaultGroup
 	// Ensure proper trimming, splitting, and converting to lowercase of excludeGroup and includeGroup
 	excludeGroups = filterEmptyStrings(strings.Split(strings.ToLower(strings.TrimSpace(config.ExcludeGroup)), ","))
 	includeGroups = filterEmptyStrings(strings.Split(strings.ToLower(strings.TrimSpace(config.IncludeGroup)), ","))
 
-	// Validate that includeGroup and excludeGroup do not overlap
-	if hasCommonElement(excludeGroups, includeGroups) {
-		fmt.Println("Error: includeGroup and excludeGroup cannot contain the same group names.")
-		return
+	namingStyle = strings.ToLower(strings.TrimSpace(config.Naming))
+	if namingStyle == "" {
+		namingStyle = namingLegacy
+	}
+	if namingStyle != namingLegacy && namingStyle != namingJellyfin {
+		return fmt.Errorf("naming must be %s or %s", namingLegacy, namingJellyfin)
+	}
+	stripPrefixes = filterEmptyStrings(strings.Split(config.StripPrefixes, ","))
+	if config.MinStreams != nil && *config.MinStreams < 0 {
+		return fmt.Errorf("invalid minStreams %d", *config.MinStreams)
 	}
 
-	if config.LogFile != "" {
-		logFile = filepath.Join(config.LogDir, config.LogFile)
-	} else {
-		logFile = ""
+	names := config.EpisodeMatchers
+	if len(names) == 0 {
+		names = defaultEpisodeMatchers
+	}
+	episodeMatchers = nil
+	for _, n := range names {
+		n = strings.ToLower(strings.TrimSpace(n))
+		found := false
+		for _, matcher := range episodeMatcherList {
+			if matcher.name == n {
+				episodeMatchers = append(episodeMatchers, matcher)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("episodeMatchers: unknown matcher %q, use standard, cross, words or absolute", n)
+		}
 	}
 
-	// Initialize keepFiles map
-	keepFiles = make(map[string]bool)
+	movieFallback, episodeFallback := legacyMovieTemplate, legacyEpisodeTemplate
+	if namingStyle == namingJellyfin {
+		movieFallback, episodeFallback = jellyfinMovieTemplate, jellyfinEpisodeTemplate
+	}
+	var err error
+	if movieTemplate, err = parsePathTemplate("movieTemplate", config.MovieTemplate, movieFallback); err != nil {
+		return err
+	}
+	if episodeTemplate, err = parsePathTemplate("episodeTemplate", config.EpisodeTemplate, episodeFallback); err != nil {
+		return err
+	}
+	if libraries, err = compileLibraries(config, movieFallback, episodeFallback, needOutput); err != nil {
+		return err
+	}
 
-	// Open log file for appending if provided
-	if config.LogFile != "" {
-		logFileHandle, err = os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-		if err != nil {
-			fmt.Println("Error opening log file:", err)
-			return
+	// Validate the download options of every source up front
+	httpOptions = config.HTTP
+	sourceHTTP = config.SourceHTTP
+	if _, err := newFetcher(httpOptions); err != nil {
+		return fmt.Errorf("http: %v", err)
+	}
+	for prefix, opts := range sourceHTTP {
+		if _, err := newFetcher(mergeHTTPOptions(httpOptions, opts)); err != nil {
+			return fmt.Errorf("sourceHttp %s: %v", prefix, err)
 		}
-		defer logFileHandle.Close()
 	}
 
-	// Log the start of the script
-	if name != "" {
-		logMessage(fmt.Sprintf("Starting GetSTRM: %s", name))
-	} else {
-		logMessage("Starting GetSTRM")
+	// Validate that includeGroup and excludeGroup do not overlap
+	if hasCommonElement(excludeGroups, includeGroups) {
+		return fmt.Errorf("includeGroup and excludeGroup cannot contain the same group names")
+	}
+	if filterRules, filterDefaultInclude, err = compileFilters(config); err != nil {
+		return err
+	}
+	if liveTV, err = compileLiveTV(config.LiveTV); err != nil {
+		return fmt.Errorf("liveTV: %v", err)
 	}
-	logDebug("Level 3 Debug turned on")
-	logMessage("Copyright (c) 2024 Jules Potvin. Licensed under CC BY-NC 4.0")
-	var streams []Stream
 
-	// Process JSON inputs
-	for i, jsonURL := range jsonURLs {
-		logMessage(fmt.Sprintf("Processing JSON URL: %s", jsonURL))
-		jsonStreams, err := processJSON(jsonURL, i)
-		if err != nil {
-			logError("Error processing JSON file:", err)
-			os.Exit(1) // Exit the script on error
+	keepDuplicates = config.KeepDuplicates
+	dedupePrefer = defaultDedupePrefer
+	if len(config.DedupePrefer) > 0 {
+		dedupePrefer = nil
+		for _, criterion := range config.DedupePrefer {
+			criterion = strings.ToLower(strings.TrimSpace(criterion))
+			if criterion != preferSource && criterion != preferQuality && criterion != preferGroup {
+				return fmt.Errorf("dedupePrefer: unknown criterion %q, use source, quality or group", criterion)
+			}
+			dedupePrefer = append(dedupePrefer, criterion)
 		}
-		streams = append(streams, jsonStreams...)
+	}
+	groupPriority = nil
+	for _, group := range config.GroupPriority {
+		groupPriority = append(groupPriority, regexp.MustCompile(globToRegexp(strings.TrimSpace(group))))
+	}
+	movieVersions = strings.ToLower(strings.TrimSpace(config.MovieVersions))
+	if movieVersions == "" {
+		movieVersions = versionsBest
+	}
+	if movieVersions != versionsBest && movieVersions != versionsAll {
+		return fmt.Errorf("movieVersions must be %s or %s", versionsBest, versionsAll)
 	}
 
-	// Process M3U inputs
-	for i, m3uURL := range m3uURLs {
-		logMessage(fmt.Sprintf("Processing M3U URL: %s", m3uURL))
-		m3uStreams, err := processM3U(m3uURL, i, stats)
-		if err != nil {
-			logError("Error processing M3U file:", err)
-			os.Exit(1) // Exit the script on error
+	for _, server := range config.MediaServers {
+		if t := strings.ToLower(server.Type); t != "emby" && t != "jellyfin" {
+			return fmt.Errorf("mediaServers: unknown type %q, use emby or jellyfin", server.Type)
 		}
-		streams = append(streams, m3uStreams...)
+		if server.URL == "" {
+			return fmt.Errorf("mediaServers: %s server without url", server.Type)
+		}
+	}
+
+	if config.LogFile != "" {
+		logFile = filepath.Join(config.LogDir, config.LogFile)
+	} else {
+		logFile = ""
 	}
+	return nil
+}
 
-	// Pass keepFiles to processStreams
-	processStreams(streams, stats, keepFiles)
+// runSyncCommand implements "GetSTRM sync" and, with planOnly, "GetSTRM plan".
+func runSyncCommand(args []string, planOnly bool) int {
+	command := "sync"
+	if planOnly {
+		command = "plan"
+	}
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	configOptions := addConfigFlags(flags)
+	dryRunFlag := flags.Bool("dryRun", false, "Show what would be created, updated and deleted without changing anything")
+	planFileFlag := flags.String("planFile", "", "Write the dry run plan as JSON to this file, - for stdout")
+	forcePruneFlag := flags.Bool("forcePrune", false, "Prune even when the prune guard detects a failed, empty or truncated source")
+	daemonFlag := flags.Bool("daemon", false, "Keep running and sync on the configured interval or schedule")
+	versionFlag := flags.Bool("version", false, "Display the version information")
+	helpFlag := flags.Bool("help", false, "Show help message")
+	flags.Parse(args)
 
-	// Clean up empty directories
-	removeEmptyDirs(tvShowsDir, stats, config.LimitDelete)
-	removeEmptyDirs(moviesDir, stats, config.LimitDelete)
+	if *versionFlag {
+		printVersion()
+		return exitOK
+	}
+	if *helpFlag {
+		showHelp()
+		return exitOK
+	}
+	if flags.NArg() > 0 {
+		fmt.Printf("Error: unexpected argument %q\n", flags.Arg(0))
+		return exitUsage
+	}
 
-	// Print the statistics for each URL
-	printStatistics(stats)
+	config, err := configOptions.load()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+	if err := applyConfig(config, true); err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
 
-	// Write keepFiles to disk if log level is 3
-	if logLevel == 3 {
-		err := writeKeepFilesToDisk()
-		if err != nil {
-			logError("Error writing keepFiles to disk:", err)
+	dryRun = planOnly || *dryRunFlag
+	forcePrune = *forcePruneFlag
+	plan = newPlan()
+
+	// Validate the daemon schedule before doing anything else
+	if *daemonFlag && dryRun {
+		fmt.Println("Error: daemon and dryRun cannot be used together.")
+		return exitUsage
+	}
+	if *daemonFlag {
+		if _, err := nextScheduledRun(config, time.Now()); err != nil {
+			fmt.Println("Error:", err)
+			return exitUsage
+		}
+		if key := stdinSource(config); key != "" {
+			fmt.Printf("Error: %s reads from stdin (-), which can only be read once and not by a daemon.\n", key)
+			return exitUsage
 		}
 	}
 
-	// Remove downloaded files if retainDownload is 0
-	if config.RetainDownload == 0 {
-		removeDownloadedFiles()
+	// Create log directory if it does not exist
+	if _, err := os.Stat(config.LogDir); os.IsNotExist(err) {
+		os.MkdirAll(config.LogDir, os.ModePerm)
+		fmt.Println("Created log directory:", config.LogDir)
+	}
+	if _, err := os.Stat(downloadDir); os.IsNotExist(err) && !dryRun {
+		os.MkdirAll(downloadDir, os.ModePerm)
+		fmt.Println("Created directory:", downloadDir)
 	}
 
-	// Log the end of the script
-	logMessage(fmt.Sprintf("End GETVOD with URL %s", jsonURLs))
+	// Stop gracefully on SIGTERM/Ctrl-C instead of leaving a half written tree
+	handleStopSignals()
+
+	defer closeLogFile()
+
+	if *daemonFlag {
+		runDaemon(config, *planFileFlag)
+	} else {
+		// Prevent overlapping runs on the same configuration
+		if !dryRun {
+			lockFile := lockPath(workingDir, name)
+			if err := acquireLock(lockFile); err != nil {
+				fmt.Println("Error:", err)
+				return exitFailed
+			}
+			defer releaseLock(lockFile)
+		}
+		if err := runSync(config, *planFileFlag, false); err != nil {
+			return exitFailed
+		}
+	}
 
 	// Save config if it wasn't loaded from a file
-	if *configFile == "" && *nameFlag != "" {
+	if *configOptions.configFile == "" && *configOptions.name != "" && !dryRun {
 		err := saveConfigToFile(config)
 		if err != nil {
 			fmt.Println("Error saving config to file:", err)
@@ -364,456 +800,4903 @@ func main() {
 			fmt.Printf("Configuration saved to %s.json\n", name)
 		}
 	}
+	return exitOK
 }
 
-func writeKeepFilesToDisk() error {
-	filePath := filepath.Join(logDir, "keepFiles.txt")
-	file, err := os.Create(filePath)
+// runValidateCommand implements "GetSTRM validate-config": it checks the
+// configuration without fetching anything or touching the disk.
+func runValidateCommand(args []string) int {
+	flags := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	configOptions := addConfigFlags(flags)
+	flags.Parse(args)
+
+	config, err := configOptions.load()
+	if err == nil {
+		err = applyConfig(config, true)
+	}
+	if err == nil && (config.Interval != "" || config.Schedule != "") {
+		_, err = nextScheduledRun(config, time.Now())
+	}
 	if err != nil {
-		return err
+		fmt.Println("Error:", err)
+		return exitUsage
 	}
-	defer file.Close()
+	fmt.Println("Configuration is valid.")
+	return exitOK
+}
 
-	for path := range keepFiles {
-		_, err := file.WriteString(path + "\n")
-		if err != nil {
-			return err
+// groupCount is one line of the groups command.
+type groupCount struct {
+	Group    string `json:"group"`
+	Movies   int    `json:"movies"`
+	Series   int    `json:"series"`
+	Rejected int    `json:"rejected"` // file type not in fileType
+	Total    int    `json:"total"`
+}
+
+// countGroups tallies the streams of every group title, sorted by name.
+func countGroups(streams []Stream) []groupCount {
+	byGroup := make(map[string]*groupCount)
+	for _, stream := range streams {
+		group := strings.TrimSpace(stream.GroupTitle)
+		if group == "" {
+			group = defaultGroup
+		}
+		count := byGroup[group]
+		if count == nil {
+			count = &groupCount{Group: group}
+			byGroup[group] = count
+		}
+		count.Total++
+		switch {
+		case stream.URL == "" && stream.SeriesName != "":
+			count.Series++ // Xtream series listed without their episodes
+		case !isValidStreamType(stream):
+			count.Rejected++
+		case isTVShow(stream):
+			count.Series++
+		default:
+			count.Movies++
 		}
 	}
-	return nil
+
+	counts := make([]groupCount, 0, len(byGroup))
+	for _, count := range byGroup {
+		counts = append(counts, *count)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		return strings.ToLower(counts[i].Group) < strings.ToLower(counts[j].Group)
+	})
+	return counts
 }
 
-func removeDownloadedFiles() {
-	files, err := ioutil.ReadDir(downloadDir)
-	if err != nil {
-		logError("Error reading download directory:", err)
-		return
+func printGroupTable(counts []groupCount) {
+	width := len("Group")
+	for _, count := range counts {
+		if len(count.Group) > width {
+			width = len(count.Group)
+		}
 	}
+	fmt.Printf("%-*s  %7s  %7s  %8s  %7s\n", width, "Group", "Movies", "Series", "Rejected", "Total")
+	var total groupCount
+	for _, count := range counts {
+		fmt.Printf("%-*s  %7d  %7d  %8d  %7d\n", width, count.Group, count.Movies, count.Series, count.Rejected, count.Total)
+		total.Movies += count.Movies
+		total.Series += count.Series
+		total.Rejected += count.Rejected
+		total.Total += count.Total
+	}
+	fmt.Printf("%-*s  %7d  %7d  %8d  %7d\n", width, fmt.Sprintf("%d groups", len(counts)), total.Movies, total.Series, total.Rejected, total.Total)
+}
 
-	for _, file := range files {
-		filePath := filepath.Join(downloadDir, file.Name())
-		if !file.IsDir() {
-			logMessage(fmt.Sprintf("Removing downloaded file: %s", filePath))
-			if err := os.Remove(filePath); err != nil {
-				logError("Error removing file:", err)
-			}
+// writeStarterConfig saves config with every group holding movies or series
+// in includeGroup, ready to be trimmed down by hand.
+func writeStarterConfig(config *Config, counts []groupCount, path string) error {
+	var groups []string
+	for _, count := range counts {
+		if count.Movies+count.Series == 0 {
+			continue
+		}
+		if strings.Contains(count.Group, ",") {
+			fmt.Fprintf(os.Stderr, "Warning: group %q contains a comma and cannot be listed in includeGroup\n", count.Group)
+			continue
 		}
+		groups = append(groups, count.Group)
+	}
+	starter := *config
+	starter.IncludeGroup = strings.Join(groups, ",")
+	starter.ExcludeGroup = ""
+	data, err := json.MarshalIndent(&starter, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The config holds the source credentials, keep it private even when
+	// it overwrites an existing file
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return err
 	}
+	return os.Chmod(path, 0600)
 }
 
-func processStreams(streams []Stream, stats map[string]int, keepFiles map[string]bool) map[string]int {
-	// Regex to identify TV shows
-	tvShowRegex := regexp.MustCompile(`S\d{1,2}E\d{1,3}`)
-	logDebug("Process Streams Start")
-	// Create root directories
-	os.MkdirAll(tvShowsDir, os.ModePerm)
-	os.MkdirAll(moviesDir, os.ModePerm)
+// runGroupsCommand implements "GetSTRM groups": it reads every source and
+// lists the group titles with their movie, series and rejected counts.
+func runGroupsCommand(args []string) int {
+	flags := flag.NewFlagSet("groups", flag.ExitOnError)
+	configOptions := addConfigFlags(flags)
+	formatFlag := flags.String("format", "table", "Output format: table or json")
+	writeConfigFlag := flags.String("writeConfig", "", "Write a starter configuration listing every group in includeGroup to this file")
+	flags.Parse(args)
 
-	// Log excludeGroups and includeGroups for debugging
-	logMessage(fmt.Sprintf("Exclude Groups: %v", excludeGroups))
-	logMessage(fmt.Sprintf("Include Groups: %v", includeGroups))
+	if *formatFlag != "table" && *formatFlag != "json" {
+		fmt.Println("Error: format must be table or json")
+		return exitUsage
+	}
+	config, err := configOptions.load()
+	if err == nil {
+		err = applyConfig(config, false)
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
 
-	for _, stream := range streams {
-		groupTitle := strings.ToLower(strings.TrimSpace(stream.GroupTitle))
+	// Read the sources without saving anything, and keep the log on stderr
+	// out of the way of the list
+	dryRun = true
+	logOutput = os.Stderr
+	if sourceCache, err = loadSourceCache(sourceCachePath()); err != nil {
+		fmt.Println("Error:", err)
+		return exitFailed
+	}
+
+	// Let every file type through so rejected streams can be counted too.
+	// Xtream series are counted from the series list, fetching the episodes
+	// of each would take one request per series.
+	validTypes := fileTypes
+	fileTypes = []string{""}
+	xtreamShowsOnly = true
+	stats := make(map[string]int)
+	streams, _, failed := fetchSources(stats)
+	fileTypes = validTypes
+	xtreamShowsOnly = false
+
+	counts := countGroups(streams)
+	if *formatFlag == "json" {
+		data, err := json.MarshalIndent(counts, "", "  ")
+		if err != nil {
+			fmt.Println("Error:", err)
+			return exitFailed
+		}
+		fmt.Println(string(data))
+	} else {
+		printGroupTable(counts)
+	}
+
+	if *writeConfigFlag != "" {
+		if err := writeStarterConfig(config, counts, *writeConfigFlag); err != nil {
+			fmt.Fprintln(os.Stderr, "Error writing starter config:", err)
+			return exitFailed
+		}
+		fmt.Fprintln(os.Stderr, "Starter configuration written to", *writeConfigFlag)
+	}
+
+	for _, source := range failed {
+		fmt.Fprintln(os.Stderr, "Error: source failed:", source)
+	}
+	if len(failed) > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// runInitCommand implements "GetSTRM init": it writes a sample configuration
+// and creates the directories it refers to.
+func runInitCommand(args []string) int {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	output := flags.String("output", "sample_config.json", "Path of the configuration file to write")
+	force := flags.Bool("force", false, "Overwrite an existing file")
+	flags.Parse(args)
+
+	if _, err := os.Stat(*output); err == nil && !*force {
+		fmt.Printf("Error: %s already exists, use -force to overwrite it\n", *output)
+		return exitFailed
+	}
+	if err := createDefaultConfig(*output); err != nil {
+		fmt.Println("Error:", err)
+		return exitFailed
+	}
+	return exitOK
+}
+
+// runSync performs one complete run: fetch every source, write the .strm
+// tree and prune what is no longer listed.
+func runSync(config *Config, planFile string, rotateLog bool) error {
+	stats := map[string]int{
+		"createdDirs":        0,
+		"keptStrmFiles":      0,
+		"createdStrmFiles":   0,
+		"updatedStrmFiles":   0,
+		"unchangedStrmFiles": 0,
+		"removedStrmFiles":   0,
+		"removedEmptyDirs":   0,
+		"processedJsonURLs":  0,
+		"processedM3UURLs":   0,
+		"processedXtream":    0,
+		"rejectedFileExts":   0,
+		"malformedEntries":   0,
+		"unchangedSources":   0,
+		"duplicateStreams":   0,
+		"foreignStrmFiles":   0,
+		"liveChannels":       0,
+		"epgProgrammes":      0,
+	}
+	createdDirs, keptStrmFiles, removedStrmFiles, removedEmptyDirs = 0, 0, 0, 0
+	plan = newPlan()
+	trash = nil
+	if config.TrashDays >= 0 && !dryRun {
+		trash = newRunTrash(trashRoot(workingDir, name))
+	}
+
+	// Initialize keepFiles map
+	keepFiles = make(map[string]bool)
+	liveStreams = nil
+
+	// Open log file for appending if provided
+	if config.LogFile != "" {
+		if err := openLogFile(rotateLog, config.LogKeep); err != nil {
+			fmt.Println("Error opening log file:", err)
+			return err
+		}
+	}
+
+	// Load the manifest of files and directories created by previous runs
+	manifestFile := manifestPath(workingDir, name)
+	var err error
+	manifest, err = loadManifest(manifestFile)
+	if err != nil {
+		logError("Error loading manifest:", err)
+		return err
+	}
+
+	// Load the validators and hashes of the previous downloads
+	sourceCache, err = loadSourceCache(sourceCachePath())
+	if err != nil {
+		logError("Error loading source cache:", err)
+		return err
+	}
+
+	// Log the start of the script
+	if name != "" {
+		logMessage(fmt.Sprintf("Starting GetSTRM: %s", name))
+	} else {
+		logMessage("Starting GetSTRM")
+	}
+	logDebug("Level 3 Debug turned on")
+	logMessage("Copyright (c) 2024 Jules Potvin. Licensed under CC BY-NC 4.0")
+	if trash != nil {
+		logMessage(fmt.Sprintf("Run ID: %s", trash.RunID))
+	}
+
+	if manifest.isNew {
+		if config.AdoptExisting == 1 {
+			adoptExisting(tvShowsDir)
+			adoptExisting(moviesDir)
+			for _, lib := range libraries {
+				adoptExisting(lib.Dir)
+			}
+		} else {
+			logMessage("No manifest found, existing .strm files will not be pruned until GetSTRM has created them")
+		}
+	}
+
+	// A failed source does not stop the others, but nothing is pruned
+	streams, counts, failed := fetchSources(stats)
+
+	// Compare with the previous run before trusting the sources for pruning
+	runStateFile := runStatePath(workingDir, name)
+	previous, err := loadRunState(runStateFile)
+	if err != nil {
+		logError("Error loading last run counts:", err)
+		return err
+	}
+	blocked := pruneBlocked(previous, counts, failed, config)
+	if len(blocked) > 0 && forcePrune {
+		logMessage("forcePrune set, ignoring the prune guard")
+		blocked = nil
+	}
+
+	// Nothing to do when every source and the configuration are the same as
+	// last time and that run removed everything it had to
+	sourceCount := len(jsonURLs) + len(m3uURLs)
+	configHash := hashConfig(config)
+	unchanged := skipUnchanged == 1 && !manifest.isNew && len(xtreamSources) == 0 && stats["unchangedSources"] == sourceCount
+	if unchanged && previous.ConfigHash != configHash {
+		logMessage("No source changed but the configuration did, running anyway")
+		unchanged = false
+	} else if unchanged && previous.DeleteLimited {
+		logMessage("No source changed but the last run stopped at limitDelete, running anyway")
+		unchanged = false
+	}
+	deleteLimited := false
+	if unchanged {
+		logMessage("No source changed since the last run, skipping")
+	} else {
+		// Pass keepFiles to processStreams
+		processStreams(streams, stats, keepFiles)
+
+		// Clean up empty directories, unless the run was interrupted or a
+		// source looks broken and keepFiles is incomplete
+		if stopRequested() {
+			logMessage("Stop requested, skipping removal of .strm files and directories")
+		} else if len(blocked) > 0 {
+			for _, reason := range blocked {
+				logMessage("Prune guard: " + reason)
+			}
+			logMessage("Skipping removal of .strm files and directories, use -forcePrune to remove them anyway")
+		} else {
+			roots := []string{tvShowsDir, moviesDir}
+			for _, lib := range libraries {
+				if lib.Prune != nil && *lib.Prune == 0 {
+					logMessage(fmt.Sprintf("Library %s: prune is 0, keeping removed streams", lib.Name))
+					continue
+				}
+				roots = append(roots, lib.Dir)
+			}
+			for _, root := range roots {
+				if removeEmptyDirs(root, stats, config.LimitDelete) {
+					deleteLimited = true
+				}
+			}
+		}
+	}
+
+	// The live TV playlist follows the sources like the .strm tree does, but
+	// only a failed source leaves it incomplete
+	if liveTV != nil {
+		if stopRequested() || len(failed) > 0 {
+			logMessage("Keeping the previous live TV playlist")
+		} else if channels, err := writeLiveTV(liveTV, liveStreams, stats); err != nil {
+			logError("Error writing live TV playlist:", err)
+		} else if len(liveTV.EPGURLs) > 0 {
+			if err := writeEPG(liveTV, channels, stats); err != nil {
+				logError("Error writing EPG:", err)
+			}
+		}
+	}
+
+	// Index the removed files so the run can be restored, then drop old runs
+	if trash != nil {
+		if err := trash.save(); err != nil {
+			logError("Error saving trash index:", err)
+		} else if len(trash.Entries) > 0 {
+			logMessage(fmt.Sprintf("Moved %d file(s) to the trash, restore them with: GetSTRM restore %s", len(trash.Entries), trash.RunID))
+		}
+		trashDays := config.TrashDays
+		if trashDays == 0 {
+			trashDays = defaultTrashDays
+		}
+		purgeTrash(trashRoot(workingDir, name), trashDays)
+	}
+
+	if dryRun {
+		printPlan(plan)
+		if planFile != "" {
+			if err := writePlanJSON(plan, planFile); err != nil {
+				logError("Error writing plan:", err)
+			}
+		}
+	} else {
+		// Persist what this run created so the next run only prunes its own files
+		if err := manifest.save(manifestFile); err != nil {
+			logError("Error saving manifest:", err)
+		}
+		if !stopRequested() {
+			if err := sourceCache.save(sourceCachePath()); err != nil {
+				logError("Error saving source cache:", err)
+			}
+		}
+
+		// Only a run that was allowed to prune becomes the new baseline
+		if !stopRequested() && len(blocked) == 0 {
+			state := &RunState{Sources: counts, ConfigHash: configHash, DeleteLimited: deleteLimited}
+			if err := state.save(runStateFile); err != nil {
+				logError("Error saving last run counts:", err)
+			}
+		}
+
+		// Let Emby/Jellyfin pick up the changes
+		refreshMediaServers(config.MediaServers, plan)
+	}
+
+	// Print the statistics for each URL
+	printStatistics(stats)
+
+	// Write keepFiles to disk if log level is 3
+	if logLevel == 3 {
+		err := writeKeepFilesToDisk()
+		if err != nil {
+			logError("Error writing keepFiles to disk:", err)
+		}
+	}
+
+	// Remove downloaded files if retainDownload is 0
+	if config.RetainDownload == 0 && !dryRun {
+		removeDownloadedFiles()
+	}
+
+	// Log the end of the script
+	logMessage(fmt.Sprintf("End GETVOD with URL %s", jsonURLs))
+	if len(failed) > 0 {
+		return fmt.Errorf("%d source(s) failed: %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// RunState holds the stream count of every source from the last run that
+// was allowed to prune. It is the baseline for the prune guard.
+type RunState struct {
+	Time    string         `json:"time"`
+	Total   int            `json:"total"`
+	Sources map[string]int `json:"sources"`
+
+	// Used by skipUnchanged: a run is only skipped with the same settings
+	// and when the last one was not stopped by limitDelete
+	ConfigHash    string `json:"configHash,omitempty"`
+	DeleteLimited bool   `json:"deleteLimited,omitempty"`
+}
+
+// hashConfig returns a hash of the effective configuration and the GetSTRM
+// version, which both decide what a run writes.
+func hashConfig(config *Config) string {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(append([]byte(version+"\n"), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+const (
+	defaultMaxDropPercent = 50
+	defaultMinStreams     = 1
+)
+
+func runStatePath(workingDir, name string) string {
+	if name == "" {
+		return filepath.Join(workingDir, "GetSTRM_lastrun.json")
+	}
+	return filepath.Join(workingDir, fmt.Sprintf("GetSTRM_lastrun_%s.json", sanitizeFileName(name)))
+}
+
+func loadRunState(path string) (*RunState, error) {
+	state := &RunState{Sources: make(map[string]int)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	if state.Sources == nil {
+		state.Sources = make(map[string]int)
+	}
+	return state, nil
+}
+
+func (s *RunState) save(path string) error {
+	s.Time = time.Now().Format(time.RFC3339)
+	s.Total = 0
+	for _, count := range s.Sources {
+		s.Total += count
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// pruneBlocked lists the reasons pruning is unsafe this run: a source that
+// failed, listed fewer than minStreams streams, or shrank by more than
+// maxDropPercent since the last run. Pruning on such a list would delete
+// everything the provider left out.
+func pruneBlocked(previous *RunState, counts map[string]int, failed []string, config *Config) []string {
+	maxDrop := config.MaxDropPercent
+	if maxDrop <= 0 {
+		maxDrop = defaultMaxDropPercent
+	}
+	minStreams := defaultMinStreams
+	if config.MinStreams != nil {
+		minStreams = *config.MinStreams
+	}
+
+	var reasons []string
+	for _, source := range failed {
+		reasons = append(reasons, fmt.Sprintf("source failed: %s", source))
+	}
+	sources := make([]string, 0, len(counts))
+	for source := range counts {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		count := counts[source]
+		if count < minStreams {
+			reasons = append(reasons, fmt.Sprintf("%s returned %d streams, minimum is %d", source, count, minStreams))
+			continue
+		}
+		last := previous.Sources[source]
+		if last > 0 && maxDrop < 100 && (last-count)*100 > last*maxDrop {
+			reasons = append(reasons, fmt.Sprintf("%s dropped from %d to %d streams, more than %d%%", source, last, count, maxDrop))
+		}
+	}
+	return reasons
+}
+
+// fetchSources reads every configured source. It returns the streams, the
+// number of streams per source and the sources that failed; a failed source
+// does not stop the others.
+func fetchSources(stats map[string]int) (streams []Stream, counts map[string]int, failed []string) {
+	counts = make(map[string]int)
+
+	// Process JSON inputs
+	for i, jsonURL := range jsonURLs {
+		logMessage(fmt.Sprintf("Processing JSON URL: %s", jsonURL))
+		jsonStreams, err := processJSON(jsonURL, i, stats)
+		if err != nil {
+			logError("Error processing JSON file:", err)
+			failed = append(failed, jsonURL)
+			continue
+		}
+		setStreamSource(jsonStreams, jsonURL)
+		counts[jsonURL] = len(jsonStreams)
+		streams = append(streams, jsonStreams...)
+	}
+
+	// Process M3U inputs. Live channels count toward the source's total, a
+	// live only playlist is not an empty source.
+	for i, m3uURL := range m3uURLs {
+		logMessage(fmt.Sprintf("Processing M3U URL: %s", m3uURL))
+		liveBefore := len(liveStreams)
+		m3uStreams, err := processM3U(m3uURL, i, stats)
+		if err != nil {
+			logError("Error processing M3U file:", err)
+			failed = append(failed, m3uURL)
+			continue
+		}
+		setStreamSource(m3uStreams, m3uURL)
+		counts[m3uURL] = len(m3uStreams) + len(liveStreams) - liveBefore
+		streams = append(streams, m3uStreams...)
+	}
+
+	// Process Xtream Codes API inputs
+	for i, source := range xtreamSources {
+		logMessage(fmt.Sprintf("Processing Xtream source: %s", source.Host))
+		liveBefore := len(liveStreams)
+		xtreamStreams, err := processXtream(source, i, stats)
+		if err != nil {
+			logError("Error processing Xtream source:", err)
+			failed = append(failed, xtreamSourceKey(source))
+			continue
+		}
+		setStreamSource(xtreamStreams, xtreamSourceKey(source))
+		counts[xtreamSourceKey(source)] = len(xtreamStreams) + len(liveStreams) - liveBefore
+		streams = append(streams, xtreamStreams...)
+	}
+
+	return streams, counts, failed
+}
+
+// stopping is set once SIGTERM or Ctrl-C is received. The current run
+// finishes the stream it is on, skips pruning and saves the manifest.
+var (
+	stopping atomic.Bool
+	stopCh   = make(chan struct{})
+)
+
+func handleStopSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		// A second signal gets the default behaviour and ends the process,
+		// for when the current stream hangs
+		signal.Stop(signals)
+		logMessage(fmt.Sprintf("Received %s, stopping (send it again to stop at once)", sig))
+		stopping.Store(true)
+		close(stopCh)
+	}()
+}
+
+func stopRequested() bool {
+	return stopping.Load()
+}
+
+func lockPath(workingDir, name string) string {
+	if name == "" {
+		return filepath.Join(workingDir, "GetSTRM.lock")
+	}
+	return filepath.Join(workingDir, fmt.Sprintf("GetSTRM_%s.lock", sanitizeFileName(name)))
+}
+
+// acquireLock creates the lock file holding our PID. A lock left behind by a
+// process that is no longer running is taken over, as is one holding our own
+// PID: in a container GetSTRM is PID 1 again after a crash.
+func acquireLock(path string) error {
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprintf(file, "%d", os.Getpid())
+			return file.Close()
+		}
+		if !os.IsExist(err) {
+			return fmt.Errorf("error creating lock file: %v", err)
+		}
+		data, _ := ioutil.ReadFile(path)
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+		if pid > 0 && pid != os.Getpid() && processRunning(pid) {
+			return fmt.Errorf("another GetSTRM run (pid %d) holds %s", pid, path)
+		}
+		fmt.Println("Removing stale lock file:", path)
+		os.Remove(path)
+	}
+	return fmt.Errorf("could not acquire lock file %s", path)
+}
+
+func releaseLock(path string) {
+	if path != "" {
+		os.Remove(path)
+	}
+}
+
+func processRunning(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// FindProcess already fails on Windows when the process is gone
+		return true
+	}
+	return proc.Signal(syscall.Signal(0)) == nil
+}
+
+// openLogFile opens logFile for appending, first rotating the previous run's
+// log when rotate is set.
+func openLogFile(rotate bool, keep int) error {
+	closeLogFile()
+	if rotate {
+		rotateLogFile(logFile, keep)
+	}
+	var err error
+	logFileHandle, err = os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	return err
+}
+
+func closeLogFile() {
+	if logFileHandle != nil {
+		logFileHandle.Close()
+		logFileHandle = nil
+	}
+}
+
+// rotateLogFile renames path to path_<timestamp> and keeps only the newest
+// keep rotated files.
+func rotateLogFile(path string, keep int) {
+	if keep <= 0 {
+		keep = 7
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size() == 0 {
+		return
+	}
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	rotated := fmt.Sprintf("%s_%s%s", base, time.Now().Format("20060102_150405"), ext)
+	if err := os.Rename(path, rotated); err != nil {
+		fmt.Println("Error rotating log file:", err)
+		return
+	}
+
+	old, _ := filepath.Glob(base + "_*" + ext)
+	sort.Strings(old)
+	for len(old) > keep {
+		os.Remove(old[0])
+		old = old[1:]
+	}
+}
+
+// nextScheduledRun returns when the daemon should start its next run after
+// from, using the cron schedule if set and the interval otherwise.
+func nextScheduledRun(config *Config, from time.Time) (time.Time, error) {
+	if config.Schedule != "" {
+		schedule, err := parseCron(config.Schedule)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return schedule.next(from), nil
+	}
+	if config.Interval == "" {
+		return time.Time{}, fmt.Errorf("daemon mode requires interval or schedule")
+	}
+	interval, err := time.ParseDuration(config.Interval)
+	if err != nil || interval <= 0 {
+		return time.Time{}, fmt.Errorf("invalid interval %q", config.Interval)
+	}
+	return from.Add(interval), nil
+}
+
+// stdinSource returns the config key listing "-" as a source, or "".
+func stdinSource(config *Config) string {
+	keys := map[string][]string{"jsonURLs": config.JsonURLs, "m3uURLs": config.M3UURLs}
+	if config.LiveTV != nil {
+		keys["liveTV.epgURLs"] = config.LiveTV.EPGURLs
+	}
+	for _, key := range []string{"jsonURLs", "m3uURLs", "liveTV.epgURLs"} {
+		for _, location := range keys[key] {
+			if strings.TrimSpace(location) == "-" {
+				return key
+			}
+		}
+	}
+	return ""
+}
+
+func runDaemon(config *Config, planFile string) {
+	var jitter time.Duration
+	if config.Jitter != "" {
+		var err error
+		jitter, err = time.ParseDuration(config.Jitter)
+		if err != nil {
+			logError("Invalid jitter, ignoring:", config.Jitter)
+			jitter = 0
+		}
+	}
+
+	// Interval schedules start right away, cron schedules wait for their slot
+	next := time.Now()
+	if config.Schedule != "" {
+		next, _ = nextScheduledRun(config, next)
+	}
+	for {
+		if jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(jitter))))
+		}
+		logMessage(fmt.Sprintf("Next run at %s", next.Format(time.RFC3339)))
+		select {
+		case <-time.After(time.Until(next)):
+		case <-stopCh:
+			return
+		}
+
+		// The lock is only held during a run, so restore and one-off syncs
+		// can run between daemon runs
+		started := time.Now()
+		lockFile := lockPath(workingDir, name)
+		if err := acquireLock(lockFile); err != nil {
+			logMessage(fmt.Sprintf("Skipping run: %v", err))
+		} else {
+			err := runSync(config, planFile, true)
+			releaseLock(lockFile)
+			if err != nil {
+				logError("Run failed, waiting for next schedule:", err)
+			}
+		}
+		if stopRequested() {
+			return
+		}
+		next, _ = nextScheduledRun(config, started)
+		if next.Before(time.Now()) {
+			next = time.Now()
+		}
+	}
+}
+
+// cronSchedule is a parsed five field cron expression:
+// minute hour day-of-month month day-of-week.
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	domAny, dowAny                bool
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: expected 5 fields", expr)
+	}
+	var c cronSchedule
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %v", expr, err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %v", expr, err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %v", expr, err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %v", expr, err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %v", expr, err)
+	}
+	if c.dow[7] {
+		c.dow[0] = true // 7 is Sunday as well
+	}
+	// A field allowing every day, "*" as well as "*/1" or "1-31", does not
+	// restrict the other one
+	c.domAny = len(c.dom) == 31
+	c.dowAny = true
+	for d := 0; d <= 6; d++ {
+		c.dowAny = c.dowAny && c.dow[d]
+	}
+	return &c, nil
+}
+
+// parseCronField expands a field such as "*/15", "1-5" or "0,30" into the
+// set of values it matches.
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("value out of range in %q", part)
+		}
+		for v := lo; v <= hi; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom[t.Day()]
+	dow := c.dow[int(t.Weekday())]
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first matching minute strictly after from.
+func (c *cronSchedule) next(from time.Time) time.Time {
+	t := from.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !c.month[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return limit
+}
+
+// mediaUpdateLimit is the number of changed paths above which a library
+// refresh is cheaper for the server than individual path updates.
+const mediaUpdateLimit = 1000
+
+type mediaUpdate struct {
+	Path       string `json:"Path"`
+	UpdateType string `json:"UpdateType"`
+}
+
+// refreshMediaServers notifies the configured Emby/Jellyfin servers, but only
+// when the run created or removed something.
+func refreshMediaServers(servers []MediaServer, p *Plan) {
+	if len(servers) == 0 {
+		return
+	}
+	var updates []mediaUpdate
+	for _, f := range p.NewFiles {
+		updates = append(updates, mediaUpdate{Path: f, UpdateType: "Created"})
+	}
+	for _, f := range p.DeletedFiles {
+		updates = append(updates, mediaUpdate{Path: f, UpdateType: "Deleted"})
+	}
+	for _, d := range p.RemovedDirs {
+		updates = append(updates, mediaUpdate{Path: d, UpdateType: "Deleted"})
+	}
+	if len(updates) == 0 {
+		logMessage("No files created or removed, skipping media server refresh")
+		return
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	for _, server := range servers {
+		var err error
+		if len(updates) <= mediaUpdateLimit {
+			err = notifyMediaUpdates(client, server, updates)
+		} else {
+			err = refreshLibraries(client, server)
+		}
+		if err != nil {
+			logError("Error refreshing media server", server.URL, ":", err)
+		} else {
+			logMessage(fmt.Sprintf("Refreshed %s server: %s", server.Type, server.URL))
+		}
+	}
+}
+
+// notifyMediaUpdates sends the individual path changes so the server only
+// scans the affected folders.
+func notifyMediaUpdates(client *http.Client, server MediaServer, updates []mediaUpdate) error {
+	mapped := make([]mediaUpdate, len(updates))
+	for i, u := range updates {
+		mapped[i] = mediaUpdate{Path: server.serverPath(u.Path), UpdateType: u.UpdateType}
+	}
+	body, err := json.Marshal(map[string][]mediaUpdate{"Updates": mapped})
+	if err != nil {
+		return err
+	}
+	return server.post(client, "/Library/Media/Updated", body)
+}
+
+// refreshLibraries refreshes the configured libraries, or every library when
+// none are listed.
+func refreshLibraries(client *http.Client, server MediaServer) error {
+	if len(server.LibraryIDs) == 0 {
+		return server.post(client, "/Library/Refresh", nil)
+	}
+	for _, id := range server.LibraryIDs {
+		endpoint := fmt.Sprintf("/Items/%s/Refresh?Recursive=true", url.PathEscape(id))
+		if err := server.post(client, endpoint, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serverPath translates a local path into the path the media server sees,
+// for servers running in a container with different mount points. Prefixes
+// only match whole path elements and the longest matching one wins.
+func (s MediaServer) serverPath(path string) string {
+	path = absPath(path)
+	locals := make([]string, 0, len(s.PathMap))
+	for local := range s.PathMap {
+		locals = append(locals, local)
+	}
+	sort.Strings(locals)
+
+	best, bestLen, rel := "", -1, ""
+	for _, local := range locals {
+		clean := filepath.Clean(local)
+		if len(clean) <= bestLen {
+			continue
+		}
+		prefix := strings.TrimSuffix(clean, string(filepath.Separator)) + string(filepath.Separator)
+		if path == clean {
+			best, bestLen, rel = local, len(clean), ""
+		} else if strings.HasPrefix(path, prefix) {
+			best, bestLen, rel = local, len(clean), strings.TrimPrefix(path, prefix)
+		}
+	}
+	if bestLen < 0 {
+		return path
+	}
+	remote := s.PathMap[best]
+	if rel == "" {
+		return remote
+	}
+	// Use the separator of the server side path
+	sep := "/"
+	if strings.Contains(remote, `\`) && !strings.Contains(remote, "/") {
+		sep = `\`
+		rel = strings.ReplaceAll(rel, "/", `\`)
+	} else {
+		rel = filepath.ToSlash(rel)
+	}
+	return strings.TrimRight(remote, sep) + sep + rel
+}
+
+func (s MediaServer) post(client *http.Client, endpoint string, body []byte) error {
+	req, err := http.NewRequest("POST", strings.TrimRight(s.URL, "/")+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	switch strings.ToLower(s.Type) {
+	case "jellyfin":
+		req.Header.Set("Authorization", fmt.Sprintf(`MediaBrowser Token="%s"`, s.APIKey))
+	case "emby":
+		req.Header.Set("X-Emby-Token", s.APIKey)
+	default:
+		return fmt.Errorf("unknown media server type %q, expected emby or jellyfin", s.Type)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+	return nil
+}
+
+func writeKeepFilesToDisk() error {
+	filePath := filepath.Join(logDir, "keepFiles.txt")
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for path := range keepFiles {
+		_, err := file.WriteString(path + "\n")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeDownloadedFiles() {
+	files, err := ioutil.ReadDir(downloadDir)
+	if err != nil {
+		logError("Error reading download directory:", err)
+		return
+	}
+
+	for _, file := range files {
+		filePath := filepath.Join(downloadDir, file.Name())
+		if !file.IsDir() && filePath != sourceCachePath() {
+			logMessage(fmt.Sprintf("Removing downloaded file: %s", filePath))
+			if err := os.Remove(filePath); err != nil {
+				logError("Error removing file:", err)
+			}
+		}
+	}
+}
+
+// isTVShow reports whether stream is an episode rather than a movie.
+func isTVShow(stream Stream) bool {
+	if stream.SeriesName != "" {
+		return true
+	}
+	_, ok := matchEpisode(stream.TvgName)
+	return ok
+}
+
+// episodeMatch is the episode number found in a name. Start and End delimit
+// the text that matched, the show title is the text before it.
+type episodeMatch struct {
+	Season      int
+	Episode     int
+	LastEpisode int // last episode of a multi-episode file, 0 for one episode
+	Start       int
+	End         int
+}
+
+// episodeMatcher recognises one way providers number episodes. parse turns
+// the submatches into season and episode and may reject the match or move its
+// Start forward.
+type episodeMatcher struct {
+	name  string
+	re    *regexp.Regexp
+	parse func(m []string) (episodeMatch, bool)
+}
+
+// episodeMatcherList lists every matcher by name, episodeMatchers in the
+// configuration picks the ones used and their order.
+var episodeMatcherList = []episodeMatcher{
+	// S01E02, S01 E02, S01E01-E02, S01E01E02, S01E01-02 and S2024E115 for
+	// daily shows, also glued to the title as in ShowS01E02
+	{"standard", regexp.MustCompile(`(?i)(?:\b|_|(\pL))S(\d{1,2}|\d{4})\s*E(\d{1,3})(?:-?E(\d{1,3})|-(\d{1,3}))?(?:\b|_)`), parseStandardEpisode},
+	// 1x05, 1x05-06, 1x05-1x06
+	{"cross", regexp.MustCompile(`(?i)(?:\b|_)(\d{1,2})x(\d{2,3})(?:-(?:\d{1,2}x)?(\d{2,3}))?(?:\b|_)`), parseSeasonEpisode},
+	// Season 2 Episode 3, Saison 2 Episode 3-4, Staffel 2 Folge 3
+	{"words", regexp.MustCompile(`(?i)\b(?:Season|Saison|Staffel)\s*(\d{1,4})\s*[,.:-]?\s*(?:Episode|Folge)\s*(\d{1,4})(?:\s*-\s*(\d{1,4}))?\b`), parseSeasonEpisode},
+	// Show - 123, absolute numbering used for anime, filed as season 1
+	{"absolute", regexp.MustCompile(`\s-\s(\d{2,4})(?:\s*$|\s+[\[(])`), parseAbsoluteEpisode},
+}
+
+var defaultEpisodeMatchers = []string{"standard", "cross", "words"}
+
+// parseSeasonEpisode reads season, episode and an optional last episode from
+// the submatches, the last episode being the first non-empty one after them.
+func parseSeasonEpisode(m []string) (episodeMatch, bool) {
+	var e episodeMatch
+	e.Season, _ = strconv.Atoi(m[1])
+	e.Episode, _ = strconv.Atoi(m[2])
+	for _, last := range m[3:] {
+		if last != "" {
+			e.LastEpisode, _ = strconv.Atoi(last)
+			break
+		}
+	}
+	if e.LastEpisode <= e.Episode {
+		e.LastEpisode = 0
+	}
+	return e, true
+}
+
+// parseStandardEpisode reads the standard matcher like parseSeasonEpisode.
+// Its first submatch is the letter a title glued to the S, which the match
+// starts after.
+func parseStandardEpisode(m []string) (episodeMatch, bool) {
+	e, ok := parseSeasonEpisode(append([]string{m[0]}, m[2:]...))
+	e.Start = len(m[1])
+	return e, ok
+}
+
+// parseAbsoluteEpisode files "Show - 123" as season 1 episode 123. Numbers
+// that look like a year ("Movie - 2019") are not episodes.
+func parseAbsoluteEpisode(m []string) (episodeMatch, bool) {
+	n, _ := strconv.Atoi(m[1])
+	if len(m[1]) == 4 && n >= 1900 && n <= 2099 {
+		return episodeMatch{}, false
+	}
+	return episodeMatch{Season: 1, Episode: n}, true
+}
+
+// matchEpisode runs the configured matchers in order and returns the first
+// episode number found in name.
+func matchEpisode(name string) (episodeMatch, bool) {
+	for _, matcher := range episodeMatchers {
+		for _, loc := range matcher.re.FindAllStringSubmatchIndex(name, -1) {
+			m := make([]string, len(loc)/2)
+			for i := range m {
+				if loc[2*i] >= 0 {
+					m[i] = name[loc[2*i]:loc[2*i+1]]
+				}
+			}
+			e, ok := matcher.parse(m)
+			if !ok {
+				continue
+			}
+			e.Start, e.End = loc[0]+e.Start, loc[1]
+			// Keep the separators out of the match
+			for e.Start < e.End && strings.ContainsRune(" _-", rune(name[e.Start])) {
+				e.Start++
+			}
+			for e.End > e.Start && strings.ContainsRune(" _[(", rune(name[e.End-1])) {
+				e.End--
+			}
+			return e, true
+		}
+	}
+	return episodeMatch{}, false
+}
+
+func processStreams(streams []Stream, stats map[string]int, keepFiles map[string]bool) map[string]int {
+	logDebug("Process Streams Start")
+	// Create root directories
+	if !dryRun {
+		os.MkdirAll(tvShowsDir, os.ModePerm)
+		os.MkdirAll(moviesDir, os.ModePerm)
+		for _, lib := range libraries {
+			os.MkdirAll(lib.Dir, os.ModePerm)
+		}
+	}
+
+	// Log excludeGroups and includeGroups for debugging
+	logMessage(fmt.Sprintf("Exclude Groups: %v", excludeGroups))
+	logMessage(fmt.Sprintf("Include Groups: %v", includeGroups))
+
+	// Parse quality, codec and language tags from the names
+	setMediaTags(streams)
+
+	// Apply the group lists and filter rules, first match wins
+	accepted := make([]Stream, 0, len(streams))
+	for _, stream := range streams {
+		ok, reason := filterStream(stream)
+		if !ok {
+			logDebug(fmt.Sprintf("Rejected (%s): %s [%s]", reason, stream.TvgName, stream.GroupTitle))
+			continue
+		}
+		logDebug(fmt.Sprintf("Accepted (%s): %s [%s]", reason, stream.TvgName, stream.GroupTitle))
+		accepted = append(accepted, stream)
+	}
+
+	// Keep a single copy of titles listed in several groups or sources
+	accepted = dedupeStreams(accepted, stats)
+
+	libraryCounts := make(map[string]int)
+	for _, stream := range accepted {
+		if stopRequested() {
+			logMessage("Stop requested, not processing remaining streams")
+			break
+		}
+		groupTitle := strings.ToLower(strings.TrimSpace(stream.GroupTitle))
 		if groupTitle == "" {
 			groupTitle = defaultGroup
 		}
 
-		// Log the current group being processed
-		logDebug(fmt.Sprintf("Processing group: %s", groupTitle))
+		// Log the current group being processed
+		logDebug(fmt.Sprintf("Processing group: %s", groupTitle))
+
+		if lib := libraryFor(stream); lib != nil {
+			// Routed to an extra library by its match rules
+			logDebug(fmt.Sprintf("Library %s: %s [%s]", lib.Name, stream.TvgName, stream.GroupTitle))
+			libraryCounts[lib.Name]++
+			if lib.Type == libraryTVShows || (lib.Type == libraryAuto && isTVShow(stream)) {
+				processTVShow(stream, lib.Dir, groupTitle, lib.episodeTemplate, lib.Type == libraryTVShows, keepFiles, stats)
+			} else {
+				processMovie(stream, lib.Dir, groupTitle, lib.movieTemplate, keepFiles, stats)
+			}
+		} else if isTVShow(stream) {
+			// It's a TV show
+			processTVShow(stream, tvShowsDir, groupTitle, episodeTemplate, false, keepFiles, stats)
+		} else {
+			// It's a movie
+			processMovie(stream, moviesDir, groupTitle, movieTemplate, keepFiles, stats)
+		}
+	}
+	for _, lib := range libraries {
+		logMessage(fmt.Sprintf("Library %s: %d streams", lib.Name, libraryCounts[lib.Name]))
+	}
+	if n := stats["foreignStrmFiles"]; n > 0 {
+		logMessage(fmt.Sprintf("Left %d existing .strm file(s) GetSTRM did not create, use -adoptExisting 1 on a first run to take them over", n))
+	}
+
+	return stats
+}
+
+// Criteria for picking the copy of a duplicated title that is kept
+const (
+	preferSource  = "source"  // earlier source in the configuration
+	preferQuality = "quality" // higher resolution tag
+	preferGroup   = "group"   // earlier group in groupPriority
+)
+
+var defaultDedupePrefer = []string{preferSource, preferQuality, preferGroup}
+
+// Values of movieVersions
+const (
+	versionsBest = "best" // keep the best copy of each movie
+	versionsAll  = "all"  // keep one copy per quality as Jellyfin versions
+)
+
+// dedupeKeyRegex collapses everything but letters and digits in titles, so
+// "Movie: Name" and "Movie Name" are the same title.
+var dedupeKeyRegex = regexp.MustCompile(`[^\pL\pN]+`)
+
+// dedupeKey identifies a copy of a title independently of the group and
+// quality it is listed with. The language is part of the key so dubbed and
+// subtitled copies are both kept.
+func dedupeKey(stream Stream) string {
+	return titleKey(stream) + "|" + languageLabel(stream)
+}
+
+// titleKey identifies a title: title and year for movies, show, season and
+// episode for episodes. With useGroup every group keeps its own copy.
+func titleKey(stream Stream) string {
+	var key string
+	if isTVShow(stream) {
+		n := episodeName(stream)
+		if !n.HasEpisode {
+			n.Title = stripMediaTags(stream.TvgName)
+		}
+		key = fmt.Sprintf("tv|%s|%d|%d|%d", dedupeTitle(n.Title), n.Year, n.Season, n.Episode)
+	} else {
+		n := parseMediaName(stream.TvgName)
+		key = fmt.Sprintf("movie|%s|%d", dedupeTitle(n.Title), n.Year)
+	}
+	if useGroup == 1 {
+		key = strings.ToLower(strings.TrimSpace(stream.GroupTitle)) + "|" + key
+	}
+	return key
+}
+
+// languageLabel returns the language prefix and language tags of a stream,
+// "FR VOSTFR" for "FR - Heat VOSTFR", or "" when it has none.
+func languageLabel(stream Stream) string {
+	_, lang := splitProviderPrefixes(stripMediaTags(normalizeName(stream.TvgName)))
+	return strings.TrimSpace(lang + " " + strings.Join(detectLanguages(stream.TvgName), " "))
+}
+
+func dedupeTitle(title string) string {
+	return strings.TrimSpace(dedupeKeyRegex.ReplaceAllString(strings.ToLower(title), " "))
+}
+
+// dedupeStreams keeps one stream per dedupeKey, chosen by the dedupePrefer
+// criteria, and logs the copies it drops. The order of streams is kept. With
+// movieVersions set to all, every quality of a movie is kept and labelled.
+func dedupeStreams(streams []Stream, stats map[string]int) []Stream {
+	if keepDuplicates == 1 {
+		return streams
+	}
+	winners := make(map[string]int) // dedupeKey -> index in kept
+	kept := make([]Stream, 0, len(streams))
+	for _, stream := range streams {
+		key := dedupeKey(stream)
+		if movieVersions == versionsAll && !isTVShow(stream) {
+			key += "|" + stream.Quality
+		}
+		i, seen := winners[key]
+		if !seen {
+			winners[key] = len(kept)
+			kept = append(kept, stream)
+			continue
+		}
+
+		stats["duplicateStreams"]++
+		winner, loser := kept[i], stream
+		if preferStream(stream, kept[i]) {
+			winner, loser = stream, kept[i]
+			kept[i] = stream
+		}
+		logDebug(fmt.Sprintf("Duplicate discarded: %s [%s] %s, keeping %s [%s] %s",
+			loser.TvgName, loser.GroupTitle, loser.Source, winner.TvgName, winner.GroupTitle, winner.Source))
+	}
+	if dropped := len(streams) - len(kept); dropped > 0 {
+		logMessage(fmt.Sprintf("Discarded %d duplicate streams, use -logLevel 3 to list them", dropped))
+	}
+
+	// Label the copies kept of a title whose names lose their tags, so they
+	// do not share a file: by language when the languages differ and, for
+	// movie versions, by quality. A copy without tags keeps the plain name.
+	copies := make(map[string][]int) // titleKey -> indexes in kept
+	for i, stream := range kept {
+		key := titleKey(stream)
+		copies[key] = append(copies[key], i)
+	}
+	for _, indexes := range copies {
+		if len(indexes) < 2 {
+			continue
+		}
+		languages, qualities := make(map[string]bool), make(map[string]bool)
+		for _, i := range indexes {
+			languages[languageLabel(kept[i])] = true
+			qualities[kept[i].Quality] = true
+		}
+		for _, i := range indexes {
+			stream := kept[i]
+			versions := movieVersions == versionsAll && !isTVShow(stream)
+			var label []string
+			if lang := languageLabel(stream); lang != "" && len(languages) > 1 && (namingStyle == namingJellyfin || versions) {
+				label = append(label, lang)
+			}
+			if stream.Quality != "" && len(qualities) > 1 && versions {
+				label = append(label, stream.Quality)
+			}
+			kept[i].Version = strings.Join(label, " ")
+		}
+	}
+	return kept
+}
+
+// preferStream reports whether a should replace b as the copy that is kept.
+// On a tie the stream seen first stays.
+func preferStream(a, b Stream) bool {
+	for _, criterion := range dedupePrefer {
+		var ra, rb int
+		switch criterion {
+		case preferSource:
+			ra, rb = -sourceRank(a.Source), -sourceRank(b.Source)
+		case preferQuality:
+			ra, rb = qualityRank(a.Quality), qualityRank(b.Quality)
+		case preferGroup:
+			ra, rb = -groupRank(a.GroupTitle), -groupRank(b.GroupTitle)
+		}
+		if ra != rb {
+			return ra > rb
+		}
+	}
+	return false
+}
+
+// sourceRank is the position of a source in the configuration.
+func sourceRank(source string) int {
+	for i, s := range jsonURLs {
+		if s == source {
+			return i
+		}
+	}
+	for i, s := range m3uURLs {
+		if s == source {
+			return len(jsonURLs) + i
+		}
+	}
+	for i, s := range xtreamSources {
+		if xtreamSourceKey(s) == source {
+			return len(jsonURLs) + len(m3uURLs) + i
+		}
+	}
+	return len(jsonURLs) + len(m3uURLs) + len(xtreamSources)
+}
+
+func qualityRank(quality string) int {
+	switch quality {
+	case "4K":
+		return 4
+	case "1080p":
+		return 3
+	case "720p":
+		return 2
+	case "SD":
+		return 1
+	}
+	return 0
+}
+
+// groupRank is the position of the first groupPriority pattern matching
+// group, groups not listed come last.
+func groupRank(group string) int {
+	group = strings.TrimSpace(group)
+	for i, re := range groupPriority {
+		if re.MatchString(group) {
+			return i
+		}
+	}
+	return len(groupPriority)
+}
+
+// FilterRule includes or excludes the streams whose group, title or URL
+// matches its glob or regular expression. Rules are checked in order and the
+// first match decides.
+type FilterRule struct {
+	Action string `json:"action"`          // include or exclude
+	Field  string `json:"field"`           // group, title or url
+	Glob   string `json:"glob,omitempty"`  // * and ? wildcards, case insensitive
+	Regex  string `json:"regex,omitempty"` // Go regular expression, (?i) for case insensitive
+
+	re   *regexp.Regexp
+	desc string
+}
+
+const (
+	filterInclude = "include"
+	filterExclude = "exclude"
+)
+
+// compileFilters turns excludeGroup, includeGroup and the filters block into
+// one ordered rule list. The group lists come first as exact, case
+// insensitive group rules. It also returns whether streams no rule matches
+// are included.
+func compileFilters(config *Config) ([]FilterRule, bool, error) {
+	var rules []FilterRule
+	for _, group := range excludeGroups {
+		rules = append(rules, FilterRule{Action: filterExclude, Field: "group",
+			re: regexp.MustCompile("(?i)^" + regexp.QuoteMeta(strings.TrimSpace(group)) + "$"), desc: fmt.Sprintf("excludeGroup %q", group)})
+	}
+	for _, group := range includeGroups {
+		rules = append(rules, FilterRule{Action: filterInclude, Field: "group",
+			re: regexp.MustCompile("(?i)^" + regexp.QuoteMeta(strings.TrimSpace(group)) + "$"), desc: fmt.Sprintf("includeGroup %q", group)})
+	}
+
+	more, defaultInclude, err := compileFilterRules(config.Filters, config.FilterDefault, len(includeGroups) > 0)
+	if err != nil {
+		return nil, false, err
+	}
+	return append(rules, more...), defaultInclude, nil
+}
+
+// compileFilterRules compiles a filters block. Streams no rule matches are
+// included unless there is an include rule, hasInclude tells whether earlier
+// rules already include some, or filterDefault says otherwise.
+func compileFilterRules(filters []FilterRule, filterDefault string, hasInclude bool) ([]FilterRule, bool, error) {
+	var rules []FilterRule
+	for i, rule := range filters {
+		rule.Action = strings.ToLower(rule.Action)
+		if rule.Action != filterInclude && rule.Action != filterExclude {
+			return nil, false, fmt.Errorf("filter %d: action must be include or exclude", i+1)
+		}
+		var err error
+		if rule, err = compileRule(rule, fmt.Sprintf("filter %d, %s", i+1, rule.Action)); err != nil {
+			return nil, false, fmt.Errorf("filter %d: %v", i+1, err)
+		}
+		if rule.Action == filterInclude {
+			hasInclude = true
+		}
+		rules = append(rules, rule)
+	}
+
+	// Without an explicit default, include rules make it an allow list
+	switch strings.ToLower(filterDefault) {
+	case "":
+		return rules, !hasInclude, nil
+	case filterInclude:
+		return rules, true, nil
+	case filterExclude:
+		return rules, false, nil
+	}
+	return nil, false, fmt.Errorf("filterDefault must be include or exclude")
+}
+
+// compileRule checks the field of a rule and compiles its glob or regular
+// expression. label starts the description shown in the debug trace.
+func compileRule(rule FilterRule, label string) (FilterRule, error) {
+	rule.Field = strings.ToLower(rule.Field)
+	if rule.Field != "group" && rule.Field != "title" && rule.Field != "url" {
+		return rule, fmt.Errorf("field must be group, title or url")
+	}
+	var err error
+	switch {
+	case rule.Glob != "" && rule.Regex != "":
+		return rule, fmt.Errorf("use either glob or regex")
+	case rule.Glob != "":
+		rule.re, err = regexp.Compile(globToRegexp(rule.Glob))
+		rule.desc = fmt.Sprintf("%s %s glob %q", label, rule.Field, rule.Glob)
+	case rule.Regex != "":
+		rule.re, err = regexp.Compile(rule.Regex)
+		rule.desc = fmt.Sprintf("%s %s regex %q", label, rule.Field, rule.Regex)
+	default:
+		return rule, fmt.Errorf("glob or regex is required")
+	}
+	return rule, err
+}
+
+// matches reports whether the field of stream the rule looks at matches it.
+func (rule FilterRule) matches(stream Stream) bool {
+	var value string
+	switch rule.Field {
+	case "group":
+		value = strings.TrimSpace(stream.GroupTitle)
+		if value == "" {
+			value = defaultGroup
+		}
+	case "title":
+		value = stream.TvgName
+	case "url":
+		value = stream.URL
+	}
+	return rule.re.MatchString(value)
+}
+
+// globToRegexp converts a glob where * matches any text, including "/",
+// and ? matches one character into a case insensitive regular expression.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("(?i)^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// filterStream applies the rules to stream and reports whether it is kept,
+// with the rule that decided for the debug trace.
+func filterStream(stream Stream) (bool, string) {
+	return applyRules(filterRules, filterDefaultInclude, stream)
+}
+
+// applyRules returns whether the first rule matching stream includes it, and
+// the rule that decided.
+func applyRules(rules []FilterRule, defaultInclude bool, stream Stream) (bool, string) {
+	for _, rule := range rules {
+		if rule.matches(stream) {
+			return rule.Action == filterInclude, rule.desc
+		}
+	}
+	if defaultInclude {
+		return true, "no rule matched, included by default"
+	}
+	return false, "no rule matched, excluded by default"
+}
+
+// compileLibraries validates the libraries block and compiles the match
+// rules and path templates of every library. Library directories may not
+// overlap each other or tvShowsDir and moviesDir, so each one is pruned on
+// its own.
+func compileLibraries(config *Config, movieFallback, episodeFallback string, needOutput bool) ([]Library, error) {
+	var libs []Library
+	names := make(map[string]bool)
+	roots := make(map[string]string)
+	if config.TvShowsDir != "" {
+		roots["tvShowsDir"] = config.TvShowsDir
+	}
+	if config.MoviesDir != "" {
+		roots["moviesDir"] = config.MoviesDir
+	}
+	for i, lib := range config.Libraries {
+		label := fmt.Sprintf("library %d", i+1)
+		if lib.Name = strings.TrimSpace(lib.Name); lib.Name == "" {
+			return nil, fmt.Errorf("%s: name is required", label)
+		}
+		label = fmt.Sprintf("library %s", lib.Name)
+		if names[strings.ToLower(lib.Name)] {
+			return nil, fmt.Errorf("%s: name is used twice", label)
+		}
+		names[strings.ToLower(lib.Name)] = true
+		if lib.Dir == "" {
+			if needOutput {
+				return nil, fmt.Errorf("%s: dir is required", label)
+			}
+		} else {
+			for other, dir := range roots {
+				if pathWithin(lib.Dir, dir) || pathWithin(dir, lib.Dir) {
+					return nil, fmt.Errorf("%s: dir overlaps %s", label, other)
+				}
+			}
+			roots[label] = lib.Dir
+		}
+
+		lib.Type = strings.ToLower(strings.TrimSpace(lib.Type))
+		if lib.Type == "" {
+			lib.Type = libraryAuto
+		}
+		if lib.Type != libraryAuto && lib.Type != libraryMovies && lib.Type != libraryTVShows {
+			return nil, fmt.Errorf("%s: type must be %s, %s or %s", label, libraryAuto, libraryMovies, libraryTVShows)
+		}
+		if len(lib.Match) == 0 {
+			return nil, fmt.Errorf("%s: match needs at least one rule", label)
+		}
+		for j, rule := range lib.Match {
+			var err error
+			if lib.Match[j], err = compileRule(rule, label); err != nil {
+				return nil, fmt.Errorf("%s, match %d: %v", label, j+1, err)
+			}
+		}
+
+		var err error
+		if lib.movieTemplate, err = parsePathTemplate(label+" movieTemplate", lib.MovieTemplate, movieFallback); err != nil {
+			return nil, err
+		}
+		if lib.episodeTemplate, err = parsePathTemplate(label+" episodeTemplate", lib.EpisodeTemplate, episodeFallback); err != nil {
+			return nil, err
+		}
+		libs = append(libs, lib)
+	}
+	return libs, nil
+}
+
+// pathWithin reports whether path is dir or below it.
+func pathWithin(path, dir string) bool {
+	rel, err := filepath.Rel(absPath(dir), absPath(path))
+	return err == nil && (rel == "." || filepath.IsLocal(rel))
+}
+
+// libraryFor returns the first library with a rule matching stream, or nil
+// when the stream goes to tvShowsDir or moviesDir.
+func libraryFor(stream Stream) *Library {
+	for i := range libraries {
+		for _, rule := range libraries[i].Match {
+			if rule.matches(stream) {
+				return &libraries[i]
+			}
+		}
+	}
+	return nil
+}
+
+const defaultLiveFileType = "ts,m3u8"
+
+// compileLiveTV validates the liveTV block, nil when live TV is not exported.
+func compileLiveTV(live *LiveTV) (*LiveTV, error) {
+	if live == nil {
+		return nil, nil
+	}
+	compiled := *live
+	if strings.TrimSpace(compiled.Output) == "" {
+		return nil, fmt.Errorf("output is required")
+	}
+	fileType := compiled.FileType
+	if strings.TrimSpace(fileType) == "" {
+		fileType = defaultLiveFileType
+	}
+	compiled.fileTypes = nil
+	for _, ext := range filterEmptyStrings(strings.Split(strings.ToLower(fileType), ",")) {
+		compiled.fileTypes = append(compiled.fileTypes, strings.TrimPrefix(strings.TrimSpace(ext), "."))
+	}
+	if compiled.StartNumber == 0 {
+		compiled.StartNumber = 1
+	}
+	if compiled.StartNumber < 0 {
+		return nil, fmt.Errorf("startNumber must be positive")
+	}
+	compiled.EPGURLs = filterEmptyStrings(compiled.EPGURLs)
+	if compiled.EPGOutput == "" {
+		compiled.EPGOutput = strings.TrimSuffix(compiled.Output, filepath.Ext(compiled.Output)) + ".xml"
+	}
+	if compiled.EPGOutput == compiled.Output {
+		return nil, fmt.Errorf("epgOutput must differ from output")
+	}
+	if compiled.EPGDays == 0 {
+		compiled.EPGDays = defaultEPGDays
+	}
+	if compiled.EPGPastHours == 0 {
+		compiled.EPGPastHours = defaultEPGPastHours
+	}
+	if compiled.EPGDays < 0 || compiled.EPGPastHours < 0 {
+		return nil, fmt.Errorf("epgDays and epgPastHours must be positive")
+	}
+	var err error
+	if compiled.rules, compiled.defaultInclude, err = compileFilterRules(compiled.Filters, compiled.FilterDefault, false); err != nil {
+		return nil, err
+	}
+	return &compiled, nil
+}
+
+// collectLiveStream keeps a stream rejected by fileType when it is a live
+// channel of the liveTV export.
+func collectLiveStream(stream Stream) {
+	if liveTV == nil {
+		return
+	}
+	ext := strings.ToLower(streamExt(stream))
+	for _, t := range liveTV.fileTypes {
+		if t == "*" || t == ext {
+			liveStreams = append(liveStreams, stream)
+			return
+		}
+	}
+}
+
+// writeLiveTV filters and numbers the live channels and writes them as an
+// M3U playlist. The file is only rewritten when its content changed. It
+// returns the channels written.
+func writeLiveTV(live *LiveTV, streams []Stream, stats map[string]int) ([]Stream, error) {
+	var channels []Stream
+	for _, stream := range streams {
+		ok, reason := applyRules(live.rules, live.defaultInclude, stream)
+		if !ok {
+			logDebug(fmt.Sprintf("Live channel rejected (%s): %s [%s]", reason, stream.TvgName, stream.GroupTitle))
+			continue
+		}
+		channels = append(channels, stream)
+	}
+	numbers := numberChannels(live, channels)
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	for i, stream := range channels {
+		b.WriteString(liveExtinf(stream, numbers[i]))
+		for _, option := range stream.Options {
+			b.WriteString(option + "\n")
+		}
+		b.WriteString(stream.URL + "\n")
+	}
+	stats["liveChannels"] = len(channels)
+
+	return channels, writeIfChanged(live.Output, []byte(b.String()), fmt.Sprintf("live TV playlist %s (%d channels)", live.Output, len(channels)))
+}
+
+// writeIfChanged writes data to filePath unless the file already holds it,
+// logging what happens to it under desc.
+func writeIfChanged(filePath string, data []byte, desc string) error {
+	if existing, err := ioutil.ReadFile(filePath); err == nil && bytes.Equal(existing, data) {
+		logMessage("Unchanged " + desc)
+		return nil
+	}
+	if dryRun {
+		logMessage("Would write " + desc)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filePath, data); err != nil {
+		return err
+	}
+	logMessage("Wrote " + desc)
+	return nil
+}
+
+const (
+	defaultEPGDays      = 3
+	defaultEPGPastHours = 6
+)
+
+// xmlAttr returns the value of an attribute of an XMLTV element.
+func xmlAttr(start xml.StartElement, name string) string {
+	for _, a := range start.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// writeEPG reads the XMLTV guides of the liveTV block and writes a guide
+// holding only the exported channels, matched on tvg-id, and their
+// programmes within the time window. A channel is taken from the first guide
+// listing it, along with its programmes, so guides can be merged without
+// overlaps; the programmes later guides list for it are left out. The channels
+// of every guide come before the programmes, as the XMLTV DTD requires.
+func writeEPG(live *LiveTV, channels []Stream, stats map[string]int) error {
+	wanted := make(map[string]bool)
+	for _, stream := range channels {
+		if id := strings.ToLower(strings.TrimSpace(stream.TvgID)); id != "" {
+			wanted[id] = true
+		}
+	}
+	if len(wanted) == 0 {
+		logMessage("No exported channel has a tvg-id, not writing the EPG")
+		return nil
+	}
+
+	now := time.Now()
+	from := now.Add(-time.Duration(live.EPGPastHours) * time.Hour)
+	to := now.AddDate(0, 0, live.EPGDays)
+
+	var channelsXML, programmesXML bytes.Buffer
+	channelEnc, programmeEnc := xml.NewEncoder(&channelsXML), xml.NewEncoder(&programmesXML)
+	owner := make(map[string]string) // channel id -> guide providing it
+	programmes := 0
+	for _, location := range live.EPGURLs {
+		logMessage(fmt.Sprintf("Processing EPG: %s", location))
+		n, err := filterEPG(location, wanted, owner, from, to, channelEnc, programmeEnc)
+		if err != nil {
+			return fmt.Errorf("%s: %v", location, err)
+		}
+		programmes += n
+	}
+	if err := channelEnc.Flush(); err != nil {
+		return err
+	}
+	if err := programmeEnc.Flush(); err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	out.WriteString(xml.Header)
+	out.WriteString(`<tv generator-info-name="GetSTRM">` + "\n")
+	out.Write(channelsXML.Bytes())
+	out.Write(programmesXML.Bytes())
+	out.WriteString("\n</tv>\n")
+	if missing := len(wanted) - len(owner); missing > 0 {
+		logMessage(fmt.Sprintf("%d exported channel(s) not found in the EPG", missing))
+	}
+	stats["epgProgrammes"] = programmes
+
+	return writeIfChanged(live.EPGOutput, out.Bytes(), fmt.Sprintf("EPG %s (%d channels, %d programmes)", live.EPGOutput, len(owner), programmes))
+}
+
+// filterEPG streams one XMLTV guide and encodes the wanted channels it is
+// the first to provide to channelEnc and their programmes overlapping
+// [from, to] to programmeEnc. It returns the number of programmes kept.
+func filterEPG(location string, wanted map[string]bool, owner map[string]string, from, to time.Time, channelEnc, programmeEnc *xml.Encoder) (int, error) {
+	r, _, err := openSource(location, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+	dec.CharsetReader = xmltvCharsetReader
+	kept := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return kept, nil
+		}
+		if err != nil {
+			return kept, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || (start.Name.Local != "channel" && start.Name.Local != "programme") {
+			continue
+		}
+		id := strings.ToLower(xmlAttr(start, "id"))
+		if start.Name.Local == "programme" {
+			id = strings.ToLower(xmlAttr(start, "channel"))
+		}
+		keep := wanted[id] && (owner[id] == "" || owner[id] == location)
+		if keep && start.Name.Local == "programme" {
+			keep = epgInWindow(xmlAttr(start, "start"), xmlAttr(start, "stop"), from, to)
+		}
+		if !keep {
+			if err := dec.Skip(); err != nil {
+				return kept, err
+			}
+			continue
+		}
+		owner[id] = location
+		enc := channelEnc
+		if start.Name.Local == "programme" {
+			enc = programmeEnc
+			kept++
+		}
+		if err := copyElement(dec, enc, start); err != nil {
+			return kept, err
+		}
+	}
+}
+
+// copyElement re-encodes the element opened by start, and everything in it,
+// from dec to enc. Entities are resolved and text is escaped again, comments
+// and indentation are dropped.
+func copyElement(dec *xml.Decoder, enc *xml.Encoder, start xml.StartElement) error {
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	for depth := 1; depth > 0; {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) == 0 {
+				continue
+			}
+		default:
+			continue
+		}
+		if err := enc.EncodeToken(xml.CopyToken(tok)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// epgInWindow reports whether a programme overlaps [from, to]. Programmes
+// with times that cannot be read are kept.
+func epgInWindow(start, stop string, from, to time.Time) bool {
+	if t, ok := parseXMLTVTime(start); ok && t.After(to) {
+		return false
+	}
+	if t, ok := parseXMLTVTime(stop); ok && t.Before(from) {
+		return false
+	}
+	return true
+}
+
+// parseXMLTVTime reads "20241016063000 +0200", the zone being optional.
+func parseXMLTVTime(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{"20060102150405 -0700", "20060102150405"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// xmltvCharsetReader decodes the ISO-8859-1 and windows-1252 guides some
+// providers still send, the XML decoder only reads UTF-8.
+func xmltvCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+		return input, nil
+	case "iso-8859-1", "iso8859-1", "latin1", "latin-1":
+		return &latin1Reader{r: bufio.NewReader(input)}, nil
+	case "windows-1252", "cp1252":
+		return &latin1Reader{r: bufio.NewReader(input), high: &windows1252}, nil
+	}
+	return nil, fmt.Errorf("unsupported charset %s", charset)
+}
+
+// windows1252 holds the characters windows-1252 puts at 0x80-0x9F, where
+// ISO-8859-1 has control codes. The five unused bytes keep their control code.
+var windows1252 = [32]rune{
+	'\u20ac', '\u0081', '\u201a', '\u0192', '\u201e', '\u2026', '\u2020', '\u2021',
+	'\u02c6', '\u2030', '\u0160', '\u2039', '\u0152', '\u008d', '\u017d', '\u008f',
+	'\u0090', '\u2018', '\u2019', '\u201c', '\u201d', '\u2022', '\u2013', '\u2014',
+	'\u02dc', '\u2122', '\u0161', '\u203a', '\u0153', '\u009d', '\u017e', '\u0178',
+}
+
+// latin1Reader converts ISO-8859-1 bytes to UTF-8, or windows-1252 bytes
+// when high is set.
+type latin1Reader struct {
+	r    *bufio.Reader
+	high *[32]rune // characters of 0x80-0x9F
+	buf  []byte
+}
+
+func (l *latin1Reader) Read(p []byte) (int, error) {
+	for len(l.buf) < len(p) {
+		c, err := l.r.ReadByte()
+		if err != nil {
+			if len(l.buf) > 0 {
+				break
+			}
+			return 0, err
+		}
+		r := rune(c)
+		if l.high != nil && c >= 0x80 && c <= 0x9f {
+			r = l.high[c-0x80]
+		}
+		l.buf = utf8.AppendRune(l.buf, r)
+	}
+	n := copy(p, l.buf)
+	l.buf = l.buf[n:]
+	return n, nil
+}
+
+// numberChannels assigns channel numbers from startNumber in playlist order.
+// With keepNumbers the provider's tvg-chno is kept and the other channels
+// get the numbers it leaves free.
+func numberChannels(live *LiveTV, channels []Stream) []int {
+	numbers := make([]int, len(channels))
+	used := make(map[int]bool)
+	if live.KeepNumbers == 1 {
+		for i, stream := range channels {
+			if n, err := strconv.Atoi(strings.TrimSpace(stream.Attributes["tvg-chno"])); err == nil && n > 0 && !used[n] {
+				numbers[i] = n
+				used[n] = true
+			}
+		}
+	}
+	next := live.StartNumber
+	for i := range channels {
+		if numbers[i] != 0 {
+			continue
+		}
+		for used[next] {
+			next++
+		}
+		numbers[i] = next
+		used[next] = true
+	}
+	return numbers
+}
+
+// liveExtinf returns the #EXTINF line of a channel with its attributes in a
+// stable order and the assigned channel number.
+func liveExtinf(stream Stream, number int) string {
+	attrs := make(map[string]string, len(stream.Attributes)+5)
+	for k, v := range stream.Attributes {
+		attrs[k] = v
+	}
+	attrs["tvg-id"] = stream.TvgID
+	attrs["tvg-name"] = stream.TvgName
+	attrs["tvg-logo"] = stream.TvgLogo
+	attrs["group-title"] = strings.TrimSpace(stream.GroupTitle)
+	attrs["tvg-chno"] = strconv.Itoa(number)
+
+	keys := []string{"tvg-id", "tvg-name", "tvg-logo", "tvg-chno", "group-title"}
+	var others []string
+	for k := range attrs {
+		switch k {
+		case "tvg-id", "tvg-name", "tvg-logo", "tvg-chno", "group-title":
+		default:
+			others = append(others, k)
+		}
+	}
+	sort.Strings(others)
+
+	var b strings.Builder
+	b.WriteString("#EXTINF:-1")
+	for _, k := range append(keys, others...) {
+		if v := attrs[k]; v != "" {
+			fmt.Fprintf(&b, " %s=\"%s\"", k, strings.ReplaceAll(v, `"`, "'"))
+		}
+	}
+	b.WriteString("," + strings.ReplaceAll(stream.TvgName, "\n", " ") + "\n")
+	return b.String()
+}
+
+// removeEmptyDirs removes the files GetSTRM created below rootDir that no
+// stream kept, then the directories left empty. It reports whether limit
+// stopped it before everything was removed.
+func removeEmptyDirs(rootDir string, stats map[string]int, limit int) bool {
+	// Create a case-insensitive map for keepFiles
+	ciKeepFiles := make(map[string]bool)
+	for k := range keepFiles {
+		ciKeepFiles[strings.ToLower(k)] = true
+	}
+
+	deletions := 0
+	limited := false
+
+	filepath.WalkDir(rootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			logError("Error accessing path", path, ":", err)
+			return err
+		}
+		if d.IsDir() {
+			// Remove files that are not in the ciKeepFiles map
+			files, err := ioutil.ReadDir(path)
+			if err != nil {
+				logError("Error reading directory:", err)
+				return err
+			}
+			for _, file := range files {
+				filePath := filepath.Join(path, file.Name())
+				if file.IsDir() {
+					continue
+				}
+				isStrm := filepath.Ext(file.Name()) == ".strm"
+				// Convert filePath to lowercase for case-insensitive comparison
+				if ciKeepFiles[strings.ToLower(filePath)] {
+					if isStrm {
+						logDebug(fmt.Sprintf("Keeping .strm file: %s", filePath))
+					}
+					continue
+				}
+				if !manifest.ownsFile(filePath) {
+					if isStrm {
+						logDebug(fmt.Sprintf("Not created by GetSTRM, leaving .strm file: %s", filePath))
+					}
+					continue
+				}
+
+				if deletions >= limit {
+					if !limited {
+						logMessage("Deletion limit reached.")
+					}
+					limited = true
+					return filepath.SkipDir
+				}
+
+				// .nfo and poster files GetSTRM wrote go the same way as
+				// the .strm files and count against the limit
+				if !dryRun {
+					if err := removeManagedFile(rootDir, filePath); err != nil {
+						logError("Error removing file:", err)
+						continue
+					}
+					manifest.forget(filePath)
+				}
+				plan.addDeletedFile(filePath)
+				deletions++
+				if isStrm {
+					removedStrmFiles++
+					stats["removedStrmFiles"]++
+				}
+			}
+
+			// Check if the directory is empty and remove it if it is
+			var isEmpty bool
+			if dryRun {
+				isEmpty, err = plan.isDirEmpty(path)
+			} else {
+				isEmpty, err = isDirEmpty(path)
+			}
+			if err != nil {
+				logError("Error checking directory:", err)
+				return err
+			}
+			if isEmpty && path != rootDir && manifest.ownsDir(path) {
+				if dryRun {
+					plan.RemovedDirs = append(plan.RemovedDirs, path)
+					removedEmptyDirs++
+					stats["removedEmptyDirs"]++
+					return filepath.SkipDir
+				}
+				logMessage(fmt.Sprintf("Removing empty directory: %s", path))
+				if err := os.Remove(path); err != nil {
+					logError("Error removing directory:", err)
+				} else {
+					manifest.forget(path)
+					plan.RemovedDirs = append(plan.RemovedDirs, path)
+					removedEmptyDirs++
+					stats["removedEmptyDirs"]++
+				}
+				return filepath.SkipDir // Skip further processing of this directory
+			}
+		}
+		return nil
+	})
+	return limited
+}
+
+// removeManagedFile moves a .strm or sidecar file to the trash, or deletes it
+// when the trash is disabled.
+func removeManagedFile(rootDir, filePath string) error {
+	if trash == nil {
+		logMessage(fmt.Sprintf("Removing file: %s", filePath))
+		return os.Remove(filePath)
+	}
+	logMessage(fmt.Sprintf("Moving file to trash: %s", filePath))
+	return trash.add(rootDir, filePath, manifest.sourceOf(filePath))
+}
+
+// Manifest records every .strm file and directory GetSTRM created, grouped by
+// the source they came from. Pruning only ever touches entries listed here.
+type Manifest struct {
+	Updated string                     `json:"updated"`
+	Sources map[string]*ManifestSource `json:"sources"`
+
+	isNew bool
+	files map[string]manifestEntry // keyed by lowercase absolute path
+	dirs  map[string]manifestEntry
+}
+
+type manifestEntry struct {
+	path   string
+	source string
+}
+
+type ManifestSource struct {
+	Files []string `json:"files"`
+	Dirs  []string `json:"dirs"`
+}
+
+// manifestPath returns the manifest location for a config name, so several
+// configs can share output directories without pruning each other's files.
+func manifestPath(workingDir, name string) string {
+	if name == "" {
+		return filepath.Join(workingDir, "GetSTRM_manifest.json")
+	}
+	return filepath.Join(workingDir, fmt.Sprintf("GetSTRM_manifest_%s.json", sanitizeFileName(name)))
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+func manifestKey(path string) string {
+	return strings.ToLower(absPath(path))
+}
+
+func loadManifest(path string) (*Manifest, error) {
+	m := &Manifest{
+		Sources: make(map[string]*ManifestSource),
+		files:   make(map[string]manifestEntry),
+		dirs:    make(map[string]manifestEntry),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		m.isNew = true
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("error parsing manifest %s: %v", path, err)
+	}
+	if m.Sources == nil {
+		m.Sources = make(map[string]*ManifestSource)
+	}
+	for source, entries := range m.Sources {
+		source = redactSource(source)
+		for _, f := range entries.Files {
+			m.files[manifestKey(f)] = manifestEntry{path: f, source: source}
+		}
+		for _, d := range entries.Dirs {
+			m.dirs[manifestKey(d)] = manifestEntry{path: d, source: source}
+		}
+	}
+	return m, nil
+}
+
+// save rebuilds the per-source lists and writes the manifest atomically.
+func (m *Manifest) save(path string) error {
+	if m == nil {
+		return nil
+	}
+	sources := make(map[string]*ManifestSource)
+	entry := func(source string) *ManifestSource {
+		if sources[source] == nil {
+			sources[source] = &ManifestSource{Files: []string{}, Dirs: []string{}}
+		}
+		return sources[source]
+	}
+	for _, f := range m.files {
+		entry(f.source).Files = append(entry(f.source).Files, f.path)
+	}
+	for _, d := range m.dirs {
+		entry(d.source).Dirs = append(entry(d.source).Dirs, d.path)
+	}
+	for _, e := range sources {
+		sort.Strings(e.Files)
+		sort.Strings(e.Dirs)
+	}
+	m.Sources = sources
+	m.Updated = time.Now().Format(time.RFC3339)
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (m *Manifest) recordFile(source, path string) {
+	if m != nil {
+		m.files[manifestKey(path)] = manifestEntry{path: absPath(path), source: redactSource(source)}
+	}
+}
+
+func (m *Manifest) recordDir(source, path string) {
+	if m != nil {
+		m.dirs[manifestKey(path)] = manifestEntry{path: absPath(path), source: redactSource(source)}
+	}
+}
+
+// secretParams are the query parameters redactSource drops from source URLs.
+var secretParams = map[string]bool{
+	"password": true, "pass": true, "pwd": true, "token": true,
+	"key": true, "apikey": true, "api_key": true, "auth": true,
+}
+
+// redactSource removes passwords and tokens from a source URL before it is
+// written to disk, as xtreamSourceKey does for Xtream sources.
+func redactSource(source string) string {
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return source
+	}
+	if u.User != nil {
+		u.User = url.User(u.User.Username())
+	}
+	query := u.Query()
+	changed := false
+	for k := range query {
+		if secretParams[strings.ToLower(k)] {
+			query.Del(k)
+			changed = true
+		}
+	}
+	if changed {
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+func (m *Manifest) ownsFile(path string) bool {
+	if m == nil {
+		return false
+	}
+	_, ok := m.files[manifestKey(path)]
+	return ok
+}
+
+func (m *Manifest) ownsDir(path string) bool {
+	if m == nil {
+		return false
+	}
+	_, ok := m.dirs[manifestKey(path)]
+	return ok
+}
+
+func (m *Manifest) forget(path string) {
+	if m != nil {
+		delete(m.files, manifestKey(path))
+		delete(m.dirs, manifestKey(path))
+	}
+}
+
+func (m *Manifest) sourceOf(path string) string {
+	if m == nil {
+		return ""
+	}
+	return m.files[manifestKey(path)].source
+}
+
+// Trash keeps the .strm and sidecar files removed by one run, below a directory named
+// after the run ID, so they can be put back with the restore command.
+type Trash struct {
+	RunID   string       `json:"runId"`
+	Entries []trashEntry `json:"entries"`
+
+	dir string
+}
+
+type trashEntry struct {
+	Path   string `json:"path"` // original location
+	File   string `json:"file"` // location relative to the run directory
+	Source string `json:"source"`
+}
+
+const (
+	defaultTrashDays = 30
+	trashIndexFile   = "trash.json"
+	runIDFormat      = "20060102_150405"
+)
+
+// trashRoot returns the trash directory of a config name in workingDir.
+func trashRoot(workingDir, name string) string {
+	if name == "" {
+		return filepath.Join(workingDir, "Trash")
+	}
+	return filepath.Join(workingDir, "Trash", sanitizeFileName(name))
+}
+
+func newTrash(root, runID string) *Trash {
+	return &Trash{RunID: runID, Entries: []trashEntry{}, dir: filepath.Join(root, runID)}
+}
+
+// newRunTrash starts the trash of a new run, its ID is the start time.
+func newRunTrash(root string) *Trash {
+	runID := time.Now().Format(runIDFormat)
+	for n := 2; ; n++ {
+		if _, err := os.Stat(filepath.Join(root, runID)); os.IsNotExist(err) {
+			return newTrash(root, runID)
+		}
+		runID = fmt.Sprintf("%s_%d", time.Now().Format(runIDFormat), n)
+	}
+}
+
+// add moves filePath below the run directory, keeping its path relative to
+// rootDir.
+func (t *Trash) add(rootDir, filePath, source string) error {
+	rel, err := filepath.Rel(rootDir, filePath)
+	if err != nil || !filepath.IsLocal(rel) {
+		rel = filepath.Base(filePath)
+	}
+	file := filepath.Join(trashFolder(rootDir), rel)
+	dest := filepath.Join(t.dir, file)
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+	if err := moveFile(filePath, dest); err != nil {
+		return err
+	}
+	t.Entries = append(t.Entries, trashEntry{Path: absPath(filePath), File: file, Source: source})
+	return nil
+}
+
+// trashFolder names the folder of rootDir in a run directory after its base
+// name and a hash of its full path, so /a/Movies and /b/Movies do not mix.
+func trashFolder(rootDir string) string {
+	sum := sha256.Sum256([]byte(filepath.Clean(absPath(rootDir))))
+	return fmt.Sprintf("%s_%s", sanitizeFileName(filepath.Base(rootDir)), hex.EncodeToString(sum[:4]))
+}
+
+// save writes the index of the run directory, nothing is written when the
+// run removed nothing.
+func (t *Trash) save() error {
+	if t == nil || len(t.Entries) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(t.dir, trashIndexFile), data)
+}
+
+func loadTrash(root, runID string) (*Trash, error) {
+	t := newTrash(root, runID)
+	data, err := ioutil.ReadFile(filepath.Join(t.dir, trashIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", filepath.Join(t.dir, trashIndexFile), err)
+	}
+	return t, nil
+}
+
+// moveFile renames src to dst, copying when they are on different file
+// systems.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(dst, data); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// purgeTrash removes the run directories older than days.
+func purgeTrash(root string, days int) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -days)
+	for _, entry := range entries {
+		if !entry.IsDir() || len(entry.Name()) < len(runIDFormat) {
+			continue
+		}
+		created, err := time.ParseInLocation(runIDFormat, entry.Name()[:len(runIDFormat)], time.Local)
+		if err != nil || !created.Before(cutoff) {
+			continue
+		}
+		logMessage(fmt.Sprintf("Purging trash of run %s", entry.Name()))
+		if err := os.RemoveAll(filepath.Join(root, entry.Name())); err != nil {
+			logError("Error purging trash:", err)
+		}
+	}
+}
+
+// listTrash prints the runs in the trash with the number of files each removed.
+func listTrash(root string) error {
+	entries, err := os.ReadDir(root)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	found := false
+	for _, entry := range entries {
+		t, err := loadTrash(root, entry.Name())
+		if err != nil {
+			continue
+		}
+		found = true
+		fmt.Printf("%s  %d file(s)\n", t.RunID, len(t.Entries))
+	}
+	if !found {
+		fmt.Println("The trash is empty.")
+	}
+	return nil
+}
+
+// restoreRun moves every file removed by runID back to its original place
+// and records it in the manifest again. Files that exist again are skipped.
+func restoreRun(root, runID string, m *Manifest) (int, error) {
+	t, err := loadTrash(root, runID)
+	if os.IsNotExist(err) {
+		return 0, fmt.Errorf("no removed files found for run %s in %s", runID, root)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	restored := 0
+	var remaining []trashEntry
+	for _, entry := range t.Entries {
+		if _, err := os.Stat(entry.Path); err == nil {
+			fmt.Println("Already exists, skipping:", entry.Path)
+			remaining = append(remaining, entry)
+			continue
+		}
+		dir := filepath.Dir(entry.Path)
+		created := missingDirs(dir)
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return restored, err
+		}
+		for _, d := range created {
+			m.recordDir(entry.Source, d)
+		}
+		if err := moveFile(filepath.Join(t.dir, entry.File), entry.Path); err != nil {
+			fmt.Println("Error restoring file:", err)
+			remaining = append(remaining, entry)
+			continue
+		}
+		m.recordFile(entry.Source, entry.Path)
+		restored++
+	}
+
+	if len(remaining) == 0 {
+		return restored, os.RemoveAll(t.dir)
+	}
+	t.Entries = remaining
+	return restored, t.save()
+}
+
+// runRestore implements "GetSTRM restore [options] <runID>".
+func runRestore(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	configFile := flags.String("config", "", "Path to the configuration file")
+	nameFlag := flags.String("name", "", "Name of the configuration")
+	workingDirFlag := flags.String("workingDir", "", "Working directory (default: current working directory)")
+	listFlag := flags.Bool("list", false, "List the runs that can be restored")
+	flags.Usage = func() {
+		fmt.Println("Usage: GetSTRM restore [-config file] [-name name] [-workingDir dir] [-list] <runID>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	config := &Config{}
+	if *configFile != "" {
+		var err error
+		if config, err = loadConfig(*configFile); err != nil {
+			fmt.Println("Error loading config file:", err)
+			return exitUsage
+		}
+	}
+	if *nameFlag != "" {
+		config.Name = *nameFlag
+	}
+	if *workingDirFlag != "" {
+		config.WorkingDir = *workingDirFlag
+	}
+	dir := config.WorkingDir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	root := trashRoot(dir, config.Name)
+
+	if *listFlag {
+		if err := listTrash(root); err != nil {
+			fmt.Println("Error:", err)
+			return exitFailed
+		}
+		return exitOK
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	lockFile := lockPath(dir, config.Name)
+	if err := acquireLock(lockFile); err != nil {
+		fmt.Println("Error:", err)
+		return exitFailed
+	}
+	defer releaseLock(lockFile)
+
+	manifestFile := manifestPath(dir, config.Name)
+	m, err := loadManifest(manifestFile)
+	if err != nil {
+		fmt.Println("Error loading manifest:", err)
+		return exitFailed
+	}
+	restored, err := restoreRun(root, flags.Arg(0), m)
+	if saveErr := m.save(manifestFile); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	fmt.Printf("Restored %d file(s) removed by run %s\n", restored, flags.Arg(0))
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitFailed
+	}
+	return exitOK
+}
+
+// missingDirs lists dir and each of its parents that do not exist yet, so
+// every level MkdirAll creates can be recorded in the manifest.
+func missingDirs(dir string) []string {
+	var missing []string
+	for {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			break
+		}
+		missing = append(missing, dir)
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return missing
+}
+
+// adoptExisting records every .strm file and directory below rootDir as owned,
+// restoring the pre-manifest behaviour for libraries GetSTRM already manages.
+func adoptExisting(rootDir string) {
+	logMessage(fmt.Sprintf("Adopting existing files in: %s", rootDir))
+	filepath.WalkDir(rootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path != rootDir {
+				manifest.recordDir("adopted", path)
+			}
+		} else if filepath.Ext(d.Name()) == ".strm" {
+			manifest.recordFile("adopted", path)
+		}
+		return nil
+	})
+}
+
+func setStreamSource(streams []Stream, source string) {
+	for i := range streams {
+		streams[i].Source = source
+	}
+}
+
+// xtreamSourceKey identifies an Xtream source without exposing its password.
+func xtreamSourceKey(source XtreamSource) string {
+	return fmt.Sprintf("%s/player_api.php?username=%s", xtreamBaseURL(source), url.QueryEscape(source.Username))
+}
+
+func isDirEmpty(dir string) (bool, error) {
+	logDebug(fmt.Sprintf("Checking if directory is empty: %s", dir))
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	_, err = f.Readdir(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+func loadConfig(configFile string) (*Config, error) {
+	config := &Config{}
+	file, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		// Check if the file exists in the current working directory
+		if !filepath.IsAbs(configFile) {
+			currentDir, _ := os.Getwd()
+			configFile = filepath.Join(currentDir, configFile)
+			file, err = ioutil.ReadFile(configFile)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, err
+		}
+	}
+	err = json.Unmarshal(file, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Trim spaces for excludeGroup and includeGroup
+	config.ExcludeGroup = strings.TrimSpace(config.ExcludeGroup)
+	config.IncludeGroup = strings.TrimSpace(config.IncludeGroup)
+	config.ExcludeGroup = strings.ReplaceAll(config.ExcludeGroup, ", ", ",")
+	config.IncludeGroup = strings.ReplaceAll(config.IncludeGroup, ", ", ",")
+
+	// Ensure proper trimming and splitting of excludeGroup and includeGroup
+	excludeGroups = filterEmptyStrings(strings.Split(strings.TrimSpace(config.ExcludeGroup), ","))
+	includeGroups = filterEmptyStrings(strings.Split(strings.TrimSpace(config.IncludeGroup), ","))
+
+	// Check for any invalid keys in the JSON file
+	var raw map[string]interface{}
+	if err := json.Unmarshal(file, &raw); err != nil {
+		return nil, err
+	}
+	for key := range raw {
+		if _, ok := configMap[key]; !ok {
+			fmt.Printf("Warning: Unrecognized configuration key: %s\n", key)
+		}
+	}
+	return config, nil
+}
+
+var configMap = map[string]struct{}{
+	"name":            {},
+	"logLevel":        {},
+	"tvShowsDir":      {},
+	"moviesDir":       {},
+	"jsonURLs":        {},
+	"m3uURLs":         {},
+	"logFile":         {},
+	"fileType":        {},
+	"workingDir":      {},
+	"logDir":          {},
+	"downloadDir":     {},
+	"retainDownload":  {},
+	"useGroup":        {},
+	"defaultGroup":    {},
+	"limitDelete":     {},
+	"excludeGroup":    {},
+	"includeGroup":    {},
+	"adoptExisting":   {},
+	"writeNfo":        {},
+	"downloadPosters": {},
+	"naming":          {},
+	"movieTemplate":   {},
+	"episodeTemplate": {},
+	"stripPrefixes":   {},
+	"interval":        {},
+	"schedule":        {},
+	"jitter":          {},
+	"logKeep":         {},
+	"xtreamSources":   {},
+	"mediaServers":    {},
+	"http":            {},
+	"sourceHttp":      {},
+	"filters":         {},
+	"filterDefault":   {},
+	"keepDuplicates":  {},
+	"dedupePrefer":    {},
+	"groupPriority":   {},
+	"movieVersions":   {},
+	"episodeMatchers": {},
+	"libraries":       {},
+	"liveTV":          {},
+	"skipUnchanged":   {},
+	"maxDropPercent":  {},
+	"minStreams":      {},
+	"trashDays":       {},
+}
+
+func saveConfigToFile(config *Config) error {
+	configPath := filepath.Join(workingDir, fmt.Sprintf("%s.json", config.Name))
+	configData, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(configPath, configData, 0644)
+}
+
+func processJSON(jsonURL string, index int, stats map[string]int) ([]Stream, error) {
+	// Open the JSON source, saving a copy locally while it is read
+	body, err := openDownload(jsonURL, ".json", index)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading json file: %v", err)
+	}
+	defer body.Close()
+
+	// Parse the JSON data
+	var streams []Stream
+	err = json.NewDecoder(body).Decode(&streams)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing json file: %v", err)
+	}
+	unchanged, err := body.finish()
+	if err != nil {
+		return nil, fmt.Errorf("error saving json file: %v", err)
+	}
+	if unchanged {
+		stats["unchangedSources"]++
+	}
+
+	return streams, nil
+}
+
+// chromeUserAgent emulates a modern Chrome browser for providers that reject
+// unknown clients. It is the default when no userAgent is configured.
+const chromeUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36"
+
+// readCloser pairs a reader with the function releasing everything behind it.
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error {
+	return r.close()
+}
+
+// isLocalSource reports whether location is "-", a file:// URL or a plain path
+// rather than something to download.
+func isLocalSource(location string) bool {
+	return location == "-" || strings.HasPrefix(location, "file://") || !strings.Contains(location, "://")
+}
+
+// openSource opens an http(s) URL, a file:// URL, a plain path or "-" for
+// stdin, and transparently decompresses gzip, xz and zip content. Downloads
+// that fail or return an HTML page are reported as errors. header is added to
+// HTTP requests; on a 304 answer the returned reader is nil.
+func openSource(location string, header http.Header) (io.ReadCloser, *http.Response, error) {
+	var raw io.ReadCloser
+	var resp *http.Response
+	switch {
+	case location == "-":
+		raw = io.NopCloser(os.Stdin)
+	case isLocalSource(location):
+		path := strings.TrimPrefix(location, "file://")
+		if runtime.GOOS == "windows" && len(path) > 2 && path[0] == '/' && path[2] == ':' {
+			path = path[1:] // file:///C:/dir/list.m3u
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		raw = file
+	default:
+		f, err := fetcherFor(location)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err = f.get(location, header)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode == http.StatusNotModified {
+			resp.Body.Close()
+			return nil, resp, nil
+		}
+		raw = resp.Body
+	}
+
+	r, err := decompress(raw)
+	if err != nil {
+		raw.Close()
+		return nil, nil, err
+	}
+	if resp != nil {
+		checked, err := rejectHTML(resp, r)
+		if err != nil {
+			// Closing the decompressed reader also ends xz and removes
+			// the zip spool file
+			r.Close()
+			return nil, nil, err
+		}
+		r = checked
+	}
+	return r, resp, nil
+}
+
+// decompress detects gzip, xz and zip content by its magic bytes and returns
+// a reader of the uncompressed data. Anything else is passed through.
+func decompress(raw io.ReadCloser) (io.ReadCloser, error) {
+	buffered := bufio.NewReaderSize(raw, 64*1024)
+	magic, _ := buffered.Peek(6)
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("error reading gzip data: %v", err)
+		}
+		return readCloser{gz, func() error {
+			gz.Close()
+			return raw.Close()
+		}}, nil
+
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		// The standard library has no xz decoder, use the xz command
+		xzPath, err := exec.LookPath("xz")
+		if err != nil {
+			return nil, fmt.Errorf("xz compressed playlists need the xz command: %v", err)
+		}
+		cmd := exec.Command(xzPath, "-dc")
+		cmd.Stdin = buffered
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		xz := &xzReader{cmd: cmd, out: out, raw: raw}
+		cmd.Stderr = &xz.stderr
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("error running xz: %v", err)
+		}
+		return xz, nil
+
+	case bytes.HasPrefix(magic, []byte{'P', 'K', 0x03, 0x04}):
+		return openZip(buffered, raw)
+	}
+
+	return readCloser{buffered, raw.Close}, nil
+}
+
+// xzReader reads the output of the xz command. A failing xz is reported
+// in place of the end of the data, so a truncated or corrupt download is
+// never taken for a complete playlist.
+type xzReader struct {
+	cmd    *exec.Cmd
+	out    io.ReadCloser
+	raw    io.Closer
+	stderr bytes.Buffer
+	eof    bool
+	waited bool
+	err    error
+}
+
+func (x *xzReader) Read(p []byte) (int, error) {
+	n, err := x.out.Read(p)
+	if err == io.EOF {
+		x.eof = true
+		if werr := x.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (x *xzReader) wait() error {
+	if !x.waited {
+		x.waited = true
+		if err := x.cmd.Wait(); err != nil {
+			x.err = fmt.Errorf("error running xz: %v %s", err, strings.TrimSpace(x.stderr.String()))
+		}
+	}
+	return x.err
+}
+
+// Close ends xz and closes the compressed source. Stopping before the end
+// kills xz, which is not an error.
+func (x *xzReader) Close() error {
+	if !x.eof && !x.waited {
+		x.out.Close()
+		x.cmd.Process.Kill()
+		err := x.raw.Close() // unblocks the copy to xz's stdin
+		x.wait()
+		return err
+	}
+	err := x.wait()
+	if rawErr := x.raw.Close(); err == nil {
+		err = rawErr
+	}
+	return err
+}
+
+// openZip spools a zip archive to a temporary file, since zip needs random
+// access, and opens the playlist inside it.
+func openZip(r io.Reader, raw io.Closer) (io.ReadCloser, error) {
+	tmp, err := os.CreateTemp("", "getstrm-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		cleanup()
+		return nil, fmt.Errorf("error reading zip data: %v", err)
+	}
+	archive, err := zip.NewReader(tmp, size)
+	if err != nil {
+		cleanup()
+		return nil, fmt.Errorf("error reading zip data: %v", err)
+	}
+
+	// Prefer a playlist, otherwise take the first file
+	var entry *zip.File
+	for _, f := range archive.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(f.Name))
+		if ext == ".m3u" || ext == ".m3u8" || ext == ".json" {
+			entry = f
+			break
+		}
+		if entry == nil {
+			entry = f
+		}
+	}
+	if entry == nil {
+		cleanup()
+		return nil, fmt.Errorf("zip archive is empty")
+	}
+	content, err := entry.Open()
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	logDebug(fmt.Sprintf("Reading %s from zip archive", entry.Name))
+	return readCloser{content, func() error {
+		content.Close()
+		cleanup()
+		return raw.Close()
+	}}, nil
+}
+
+const (
+	defaultHTTPTimeout = 60 * time.Second
+	defaultHTTPRetries = 3
+	maxRetryDelay      = 2 * time.Minute
+)
+
+// fetcher downloads sources with a timeout, retries and the configured
+// proxy, User-Agent and headers.
+type fetcher struct {
+	client    *http.Client
+	timeout   time.Duration
+	retries   int
+	userAgent string
+	headers   map[string]string
+}
+
+// fetchers caches one fetcher per sourceHttp key so connections are reused.
+var fetchers = map[string]*fetcher{}
+
+// mergeHTTPOptions returns base with every option set in override replacing it.
+// Headers are merged.
+func mergeHTTPOptions(base, override HTTPOptions) HTTPOptions {
+	merged := base
+	if override.Timeout != "" {
+		merged.Timeout = override.Timeout
+	}
+	if override.Retries != nil {
+		merged.Retries = override.Retries
+	}
+	if override.UserAgent != "" {
+		merged.UserAgent = override.UserAgent
+	}
+	if override.Proxy != "" {
+		merged.Proxy = override.Proxy
+	}
+	if len(override.Headers) > 0 {
+		merged.Headers = make(map[string]string)
+		for k, v := range base.Headers {
+			merged.Headers[k] = v
+		}
+		for k, v := range override.Headers {
+			merged.Headers[k] = v
+		}
+	}
+	return merged
+}
+
+// fetcherFor returns the fetcher for location, using the sourceHttp entry
+// with the longest matching prefix.
+func fetcherFor(location string) (*fetcher, error) {
+	key := ""
+	for prefix := range sourceHTTP {
+		if strings.HasPrefix(location, prefix) && len(prefix) > len(key) {
+			key = prefix
+		}
+	}
+	if f, ok := fetchers[key]; ok {
+		return f, nil
+	}
+
+	opts := httpOptions
+	if key != "" {
+		opts = mergeHTTPOptions(httpOptions, sourceHTTP[key])
+	}
+	f, err := newFetcher(opts)
+	if err != nil {
+		return nil, err
+	}
+	fetchers[key] = f
+	return f, nil
+}
+
+func newFetcher(opts HTTPOptions) (*fetcher, error) {
+	timeout := defaultHTTPTimeout
+	if opts.Timeout != "" {
+		d, err := time.ParseDuration(opts.Timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q", opts.Timeout)
+		}
+		timeout = d
+	}
+	retries := defaultHTTPRetries
+	if opts.Retries != nil {
+		if *opts.Retries < 0 {
+			return nil, fmt.Errorf("invalid retries %d", *opts.Retries)
+		}
+		retries = *opts.Retries
+	}
+	userAgent := opts.UserAgent
+	if userAgent == "" {
+		userAgent = chromeUserAgent
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.Proxy != "" {
+		proxyURL, err := url.Parse(opts.Proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q", opts.Proxy)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q, use http, https or socks5", proxyURL.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	transport.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = timeout
+	transport.ResponseHeaderTimeout = timeout
+
+	return &fetcher{
+		client:    &http.Client{Transport: transport},
+		timeout:   timeout,
+		retries:   retries,
+		userAgent: userAgent,
+		headers:   opts.Headers,
+	}, nil
+}
+
+// get downloads location and returns the response of the first 2xx or 304
+// answer. Network errors, 429 and 5xx responses are retried with exponential
+// backoff, any other status fails at once.
+func (f *fetcher) get(location string, header http.Header) (*http.Response, error) {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		resp, err := f.do(location, header)
+		if urlErr, ok := err.(*url.Error); ok {
+			// The URL of a network error may carry credentials, such as
+			// those of the Xtream API
+			urlErr.URL = redactSource(urlErr.URL)
+		}
+		if err == nil && (resp.StatusCode >= 200 && resp.StatusCode < 300 || resp.StatusCode == http.StatusNotModified) {
+			return resp, nil
+		}
+		retry := true
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("server returned %s", resp.Status)
+			retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		}
+		if !retry || attempt >= f.retries || stopRequested() {
+			return nil, err
+		}
+
+		logMessage(fmt.Sprintf("Download failed (%v), retry %d of %d in %s", err, attempt+1, f.retries, delay))
+		select {
+		case <-time.After(delay):
+		case <-stopCh:
+			return nil, err
+		}
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// do sends a single request. The body fails when the server sends nothing
+// for longer than the timeout, so a stalled provider cannot hang the run.
+func (f *fetcher) do(location string, header http.Header) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("User-Agent", f.userAgent)
+	for k, v := range f.headers {
+		req.Header.Set(k, v)
+	}
+	for k := range header {
+		req.Header.Set(k, header.Get(k))
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	timer := time.AfterFunc(f.timeout, cancel)
+	timer.Stop()
+	resp.Body = &idleTimeoutBody{body: resp.Body, ctx: ctx, cancel: cancel, timer: timer, timeout: f.timeout}
+	return resp, nil
+}
+
+// idleTimeoutBody cancels the request when a single read blocks for longer
+// than timeout.
+type idleTimeoutBody struct {
+	body    io.ReadCloser
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.body.Read(p)
+	b.timer.Stop()
+	if err != nil && err != io.EOF && b.ctx.Err() != nil {
+		err = fmt.Errorf("no data received for %s", b.timeout)
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.body.Close()
+}
+
+// rejectHTML fails when a download turns out to be a web page, such as a
+// provider's login or error page served with a 200 status, so it is never
+// parsed as a playlist.
+func rejectHTML(resp *http.Response, r io.ReadCloser) (io.ReadCloser, error) {
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/html" {
+		return nil, fmt.Errorf("server returned an HTML page instead of a playlist")
+	}
+	buffered := bufio.NewReader(r)
+	head, _ := buffered.Peek(512)
+	if strings.HasPrefix(http.DetectContentType(head), "text/html") {
+		return nil, fmt.Errorf("server returned an HTML page instead of a playlist")
+	}
+	return readCloser{buffered, r.Close}, nil
+}
+
+// SourceCache records the validators and content hash of every downloaded
+// source, so unchanged playlists are not downloaded or processed again.
+type SourceCache struct {
+	Sources map[string]*cachedSource `json:"sources"`
+}
+
+type cachedSource struct {
+	File         string    `json:"file,omitempty"` // cached copy in downloadDir, kept with retainDownload
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	SHA256       string    `json:"sha256"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+func sourceCachePath() string {
+	return filepath.Join(downloadDir, "GetSTRM_sources.json")
+}
+
+func loadSourceCache(path string) (*SourceCache, error) {
+	cache := &SourceCache{Sources: make(map[string]*cachedSource)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cache); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	if cache.Sources == nil {
+		cache.Sources = make(map[string]*cachedSource)
+	}
+	return cache, nil
+}
+
+func (c *SourceCache) save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// cachedCopy returns the entry for location when its cached copy still exists.
+func (c *SourceCache) cachedCopy(location string) *cachedSource {
+	entry := c.Sources[location]
+	if entry == nil || entry.File == "" {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(downloadDir, entry.File)); err != nil {
+		return nil
+	}
+	return entry
+}
+
+// cacheFileName is the stable name of the cached copy of location.
+func cacheFileName(location, ext string) string {
+	sum := sha256.Sum256([]byte(location))
+	return fmt.Sprintf("GetSTRM_%s%s", hex.EncodeToString(sum[:6]), ext)
+}
+
+// sourceDownload reads a source while hashing it and saving a copy to
+// downloadDir. With retainDownload the copy is kept under a stable name and
+// sent as a conditional request next time; a 304 answer reads the copy.
+type sourceDownload struct {
+	io.Reader
+	source       io.ReadCloser
+	location     string
+	file         *os.File
+	path         string
+	hash         hash.Hash
+	etag         string
+	lastModified string
+	cached       bool
+	done         bool
+}
+
+func openDownload(location, ext string, index int) (*sourceDownload, error) {
+	remote := !isLocalSource(location)
+	header := http.Header{}
+	var entry *cachedSource
+	if remote && retainDownload == 1 {
+		if entry = sourceCache.cachedCopy(location); entry != nil {
+			if entry.ETag != "" {
+				header.Set("If-None-Match", entry.ETag)
+			}
+			if entry.LastModified != "" {
+				header.Set("If-Modified-Since", entry.LastModified)
+			}
+		}
+	}
+
+	source, resp, err := openSource(location, header)
+	if err != nil {
+		return nil, err
+	}
+	d := &sourceDownload{location: location, hash: sha256.New()}
+	if resp != nil && resp.StatusCode == http.StatusNotModified {
+		if entry == nil {
+			return nil, fmt.Errorf("server returned %s without a cached copy", resp.Status)
+		}
+		cachedFile := filepath.Join(downloadDir, entry.File)
+		logMessage(fmt.Sprintf("Not modified since %s, using cached copy: %s", entry.Fetched.Format(time.RFC3339), cachedFile))
+		if source, _, err = openSource(cachedFile, nil); err != nil {
+			return nil, err
+		}
+		d.source, d.Reader, d.cached = source, source, true
+		return d, nil
+	}
+	if resp != nil {
+		d.etag = resp.Header.Get("ETag")
+		d.lastModified = resp.Header.Get("Last-Modified")
+	}
+
+	d.source = source
+	d.Reader = io.TeeReader(source, d.hash)
+	if !dryRun && (location == "-" || remote) {
+		if retainDownload == 1 && remote {
+			d.path = filepath.Join(downloadDir, cacheFileName(location, ext))
+		} else {
+			d.path = filepath.Join(downloadDir, fmt.Sprintf("GetSTRM_%d_%s%s", index, time.Now().Format("20060102_150405"), ext))
+		}
+		if d.file, err = os.CreateTemp(downloadDir, ".getstrm-*.tmp"); err != nil {
+			source.Close()
+			return nil, fmt.Errorf("error saving %s file: %v", strings.TrimPrefix(ext, "."), err)
+		}
+		d.Reader = io.TeeReader(source, io.MultiWriter(d.file, d.hash))
+	}
+	return d, nil
+}
+
+// finish is called once the source was parsed successfully. It keeps the
+// saved copy, records it in the source cache and reports whether the content
+// is the same as last time.
+func (d *sourceDownload) finish() (bool, error) {
+	d.done = true
+	if d.cached {
+		return true, nil
+	}
+	sum := hex.EncodeToString(d.hash.Sum(nil))
+	previous := sourceCache.Sources[d.location]
+	unchanged := previous != nil && previous.SHA256 == sum
+
+	entry := &cachedSource{SHA256: sum, ETag: d.etag, LastModified: d.lastModified, Fetched: time.Now()}
+	if d.file != nil {
+		d.file.Close()
+		if err := os.Rename(d.file.Name(), d.path); err != nil {
+			os.Remove(d.file.Name())
+			return false, err
+		}
+		logMessage(fmt.Sprintf("Saved file: %s", d.path))
+		if retainDownload == 1 && !isLocalSource(d.location) {
+			entry.File = filepath.Base(d.path)
+		}
+	}
+	sourceCache.Sources[d.location] = entry
+	if unchanged {
+		logMessage(fmt.Sprintf("Content unchanged since %s", previous.Fetched.Format(time.RFC3339)))
+	}
+	return unchanged, nil
+}
+
+func (d *sourceDownload) Close() error {
+	if d.file != nil && !d.done {
+		d.file.Close()
+		os.Remove(d.file.Name())
+	}
+	return d.source.Close()
+}
+
+func processM3U(m3uURL string, index int, stats map[string]int) ([]Stream, error) {
+	// Stream the playlist through the parser, saving a copy on the way
+	body, err := openDownload(m3uURL, ".m3u", index)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading m3u file: %v", err)
+	}
+	defer body.Close()
+
+	streams, err := parseM3UStream(body, stats)
+	if err != nil {
+		return nil, fmt.Errorf("error reading m3u file: %v", err)
+	}
+	unchanged, err := body.finish()
+	if err != nil {
+		return nil, fmt.Errorf("error saving m3u file: %v", err)
+	}
+	if unchanged {
+		stats["unchangedSources"]++
+	}
+
+	return streams, nil
+}
+
+// parseM3UStream parses a playlist line by line as it is read and returns the
+// streams with a valid file type, so the raw playlist is never held in
+// memory. Lines of any length are supported.
+func parseM3UStream(r io.Reader, stats map[string]int) ([]Stream, error) {
+	var streams []Stream
+	parser := newM3UParser()
+	malformed := 0
+	report := func(err error) {
+		malformed++
+		stats["malformedEntries"]++
+		if malformed <= maxReportedErrors {
+			logError("Malformed M3U entry:", err)
+		} else {
+			logDebug(fmt.Sprintf("Malformed M3U entry: %v", err))
+		}
+	}
+
+	reader := bufio.NewReaderSize(r, 64*1024)
+	lineNo := 0
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return nil, readErr
+		}
+		if line != "" {
+			lineNo++
+			entry, err := parser.parseLine(lineNo, line)
+			if err != nil {
+				report(err)
+			}
+			if entry != nil {
+				stream := streamFromEntry(entry)
+				if isValidStreamType(stream) {
+					streams = append(streams, stream)
+				} else {
+					logDebug(fmt.Sprintf("Rejected: %v", stream))
+					stats["rejectedFileExts"]++
+					collectLiveStream(stream)
+				}
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+	if err := parser.finish(); err != nil {
+		report(err)
+	}
+	if malformed > maxReportedErrors {
+		logError(fmt.Sprintf("%d malformed M3U entries in total", malformed))
+	}
+	return streams, nil
+}
+
+// maxReportedErrors limits how many malformed entries are logged individually
+// at the basic log level.
+const maxReportedErrors = 20
+
+// M3UEntry is one #EXTINF entry of an extended M3U/M3U8 playlist.
+type M3UEntry struct {
+	Line       int               // line number of the #EXTINF line
+	Duration   string            // -1 for live and VOD streams
+	Attributes map[string]string // tvg-id, tvg-name, tvg-logo, group-title, catchup, ...
+	Title      string            // display title after the comma
+	Group      string            // from #EXTGRP
+	Options    []string          // raw #EXTVLCOPT and #KODIPROP lines
+	URL        string
+}
+
+// M3UError reports a malformed playlist entry.
+type M3UError struct {
+	Line int
+	Msg  string
+}
+
+func (e *M3UError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// m3uParser is a line by line extended M3U parser. Feed it every line in
+// order and it returns each entry once its URL has been read.
+type m3uParser struct {
+	Header  map[string]string // attributes of the #EXTM3U line, e.g. url-tvg
+	current *M3UEntry
+	group   string
+	options []string
+}
+
+func newM3UParser() *m3uParser {
+	return &m3uParser{Header: make(map[string]string)}
+}
+
+// parseLine handles one playlist line. It returns a completed entry, an error
+// for a malformed line, or neither.
+func (p *m3uParser) parseLine(lineNo int, line string) (*M3UEntry, error) {
+	line = strings.TrimSpace(strings.TrimPrefix(line, "\uFEFF"))
+	switch {
+	case line == "":
+		return nil, nil
+	case strings.HasPrefix(line, "#EXTM3U"):
+		attrs, _, err := parseM3UAttributes(strings.TrimPrefix(line, "#EXTM3U"), false)
+		for k, v := range attrs {
+			p.Header[k] = v
+		}
+		if err != nil {
+			return nil, &M3UError{Line: lineNo, Msg: err.Error()}
+		}
+		return nil, nil
+	case strings.HasPrefix(line, "#EXTINF:"):
+		var err error
+		if p.current != nil {
+			err = &M3UError{Line: p.current.Line, Msg: "#EXTINF without URL"}
+		}
+		entry, perr := parseExtinf(line)
+		entry.Line = lineNo
+		entry.Group = p.group
+		entry.Options = p.options
+		p.current, p.group, p.options = entry, "", nil
+		if perr != nil && err == nil {
+			err = &M3UError{Line: lineNo, Msg: perr.Error()}
+		}
+		return nil, err
+	case strings.HasPrefix(line, "#EXTGRP:"):
+		group := strings.TrimSpace(strings.TrimPrefix(line, "#EXTGRP:"))
+		if p.current != nil {
+			p.current.Group = group
+		} else {
+			p.group = group
+		}
+		return nil, nil
+	case strings.HasPrefix(line, "#EXTVLCOPT:"), strings.HasPrefix(line, "#KODIPROP:"):
+		if p.current != nil {
+			p.current.Options = append(p.current.Options, line)
+		} else {
+			p.options = append(p.options, line)
+		}
+		return nil, nil
+	case strings.HasPrefix(line, "#"):
+		return nil, nil // comment or unsupported directive
+	}
+
+	// Anything else is the URL of the current entry
+	if p.current == nil {
+		return nil, &M3UError{Line: lineNo, Msg: "URL without #EXTINF"}
+	}
+	entry := p.current
+	entry.URL = line
+	p.current = nil
+	return entry, nil
+}
+
+// finish reports an #EXTINF left without URL at the end of the playlist.
+func (p *m3uParser) finish() error {
+	if p.current != nil {
+		line := p.current.Line
+		p.current = nil
+		return &M3UError{Line: line, Msg: "#EXTINF without URL"}
+	}
+	return nil
+}
+
+// parseExtinf parses `#EXTINF:<duration> key="value" ...,<title>`. The entry
+// is returned even on error so the caller can still use what was parsed.
+func parseExtinf(line string) (*M3UEntry, error) {
+	rest := strings.TrimPrefix(line, "#EXTINF:")
+	end := strings.IndexAny(rest, " \t,")
+	if end < 0 {
+		end = len(rest)
+	}
+	entry := &M3UEntry{Duration: rest[:end]}
+	attrs, title, err := parseM3UAttributes(rest[end:], true)
+	entry.Attributes = attrs
+	entry.Title = strings.TrimSpace(title)
+	return entry, err
+}
+
+// parseM3UAttributes reads key=value pairs with double quoted, single quoted
+// or bare values. Inside quotes a backslash escapes the next character. With
+// withTitle set, parsing stops at the first comma outside quotes and the rest
+// of the line is returned as the title.
+func parseM3UAttributes(s string, withTitle bool) (map[string]string, string, error) {
+	attrs := make(map[string]string)
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		if c == ' ' || c == '\t' {
+			i++
+			continue
+		}
+		if c == ',' {
+			if withTitle {
+				return attrs, s[i+1:], nil
+			}
+			i++ // stray separator in the #EXTM3U header
+			continue
+		}
+
+		// Key
+		start := i
+		for i < len(s) && s[i] != '=' && s[i] != ' ' && s[i] != '\t' && s[i] != ',' {
+			i++
+		}
+		key := strings.ToLower(s[start:i])
+		if i >= len(s) || s[i] != '=' {
+			continue // bare word without value
+		}
+		i++
+
+		// Value
+		if i < len(s) && (s[i] == '"' || s[i] == '\'') {
+			quote := s[i]
+			i++
+			var value strings.Builder
+			closed := false
+			for i < len(s) {
+				if s[i] == '\\' && i+1 < len(s) && (s[i+1] == quote || s[i+1] == '\\') {
+					value.WriteByte(s[i+1])
+					i += 2
+					continue
+				}
+				if s[i] == quote {
+					closed = true
+					i++
+					break
+				}
+				value.WriteByte(s[i])
+				i++
+			}
+			attrs[key] = value.String()
+			if !closed {
+				return attrs, "", fmt.Errorf("unterminated quote in attribute %s", key)
+			}
+		} else {
+			// Header values such as url-tvg=http://a,http://b list
+			// several URLs, only #EXTINF has a title after the comma
+			start = i
+			for i < len(s) && s[i] != ' ' && s[i] != '\t' && (s[i] != ',' || !withTitle) {
+				i++
+			}
+			attrs[key] = s[start:i]
+		}
+	}
+	if withTitle {
+		return attrs, "", fmt.Errorf("missing title after comma")
+	}
+	return attrs, "", nil
+}
+
+// streamFromEntry maps a playlist entry to a Stream. tvg-name falls back to
+// the display title and group-title to #EXTGRP.
+func streamFromEntry(entry *M3UEntry) Stream {
+	stream := Stream{
+		URL:        entry.URL,
+		TvgName:    entry.Attributes["tvg-name"],
+		GroupTitle: entry.Attributes["group-title"],
+		TvgID:      entry.Attributes["tvg-id"],
+		TvgLogo:    entry.Attributes["tvg-logo"],
+		Attributes: entry.Attributes,
+		Options:    entry.Options,
+	}
+	if strings.TrimSpace(stream.TvgName) == "" {
+		stream.TvgName = entry.Title
+	}
+	if stream.GroupTitle == "" {
+		stream.GroupTitle = entry.Group
+	}
+	return stream
+}
+
+// flexString decodes fields that providers return either as a JSON string or
+// as a JSON number.
+type flexString string
+
+func (v *flexString) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*v = flexString(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err == nil {
+		*v = flexString(n.String())
+		return nil
+	}
+	*v = ""
+	return nil
+}
+
+func (v flexString) Int() int {
+	n, _ := strconv.Atoi(strings.TrimSpace(string(v)))
+	return n
+}
+
+type xtreamCategory struct {
+	CategoryID   flexString `json:"category_id"`
+	CategoryName string     `json:"category_name"`
+}
+
+type xtreamVod struct {
+	Name               string     `json:"name"`
+	StreamID           flexString `json:"stream_id"`
+	CategoryID         flexString `json:"category_id"`
+	ContainerExtension string     `json:"container_extension"`
+	StreamIcon         string     `json:"stream_icon"`
+	Rating             flexString `json:"rating"`
+	Year               flexString `json:"year"`
+	Plot               string     `json:"plot"`
+}
+
+type xtreamLive struct {
+	Num          flexString `json:"num"`
+	Name         string     `json:"name"`
+	StreamID     flexString `json:"stream_id"`
+	CategoryID   flexString `json:"category_id"`
+	StreamIcon   string     `json:"stream_icon"`
+	EPGChannelID string     `json:"epg_channel_id"`
+}
+
+type xtreamSeries struct {
+	Name       string     `json:"name"`
+	SeriesID   flexString `json:"series_id"`
+	CategoryID flexString `json:"category_id"`
+	Cover      string     `json:"cover"`
+	Plot       string     `json:"plot"`
+	Rating     flexString `json:"rating"`
+	Year       flexString `json:"year"`
+}
+
+type xtreamEpisode struct {
+	ID                 flexString      `json:"id"`
+	EpisodeNum         flexString      `json:"episode_num"`
+	Title              string          `json:"title"`
+	ContainerExtension string          `json:"container_extension"`
+	Season             flexString      `json:"season"`
+	Info               json.RawMessage `json:"info"`
+}
+
+// xtreamEpisodeInfo is the optional metadata of an episode. Panels send an
+// empty array instead of an object when there is none.
+type xtreamEpisodeInfo struct {
+	Plot       string     `json:"plot"`
+	MovieImage string     `json:"movie_image"`
+	Rating     flexString `json:"rating"`
+}
+
+func (e xtreamEpisode) info() xtreamEpisodeInfo {
+	var info xtreamEpisodeInfo
+	if len(e.Info) > 0 && e.Info[0] == '{' {
+		json.Unmarshal(e.Info, &info)
+	}
+	return info
+}
+
+type xtreamSeriesInfo struct {
+	Episodes map[string][]xtreamEpisode `json:"episodes"`
+}
+
+// xtreamBaseURL returns the scheme://host[:port] part of an Xtream source,
+// defaulting to http when no scheme is given.
+func xtreamBaseURL(source XtreamSource) string {
+	host := strings.TrimRight(strings.TrimSpace(source.Host), "/")
+	host = strings.TrimSuffix(host, "/player_api.php")
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	return host
+}
+
+// xtreamGet calls a player_api.php action and decodes the JSON response into v.
+func xtreamGet(source XtreamSource, action string, extra url.Values, v interface{}) error {
+	params := url.Values{}
+	params.Set("username", source.Username)
+	params.Set("password", source.Password)
+	params.Set("action", action)
+	for k, vals := range extra {
+		for _, val := range vals {
+			params.Add(k, val)
+		}
+	}
+	apiURL := xtreamBaseURL(source) + "/player_api.php?" + params.Encode()
+
+	f, err := fetcherFor(apiURL)
+	if err != nil {
+		return err
+	}
+	resp, err := f.get(apiURL, nil)
+	if err != nil {
+		return xtreamError(source, "error calling xtream %s: %v", action, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return xtreamError(source, "error reading xtream %s: %v", action, err)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("error parsing xtream %s: %v", action, err)
+	}
+	return nil
+}
+
+// xtreamError formats an error with the password of source masked, network
+// errors quote the request URL which carries it.
+func xtreamError(source XtreamSource, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if source.Password != "" {
+		for _, p := range []string{url.QueryEscape(source.Password), url.PathEscape(source.Password), source.Password} {
+			msg = strings.ReplaceAll(msg, p, "***")
+		}
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+// xtreamCategories maps category IDs to category names for the given action.
+func xtreamCategories(source XtreamSource, action string) (map[string]string, error) {
+	var categories []xtreamCategory
+	if err := xtreamGet(source, action, nil, &categories); err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(categories))
+	for _, c := range categories {
+		names[string(c.CategoryID)] = c.CategoryName
+	}
+	return names, nil
+}
+
+func processXtream(source XtreamSource, index int, stats map[string]int) ([]Stream, error) {
+	base := xtreamBaseURL(source)
+	user := url.PathEscape(source.Username)
+	pass := url.PathEscape(source.Password)
+	var streams []Stream
+
+	// Movies
+	vodCategories, err := xtreamCategories(source, "get_vod_categories")
+	if err != nil {
+		return nil, err
+	}
+	var vods []xtreamVod
+	if err := xtreamGet(source, "get_vod_streams", nil, &vods); err != nil {
+		return nil, err
+	}
+	for _, vod := range vods {
+		stream := Stream{
+			URL:        fmt.Sprintf("%s/movie/%s/%s/%s.%s", base, user, pass, vod.StreamID, vod.ContainerExtension),
+			TvgName:    vod.Name,
+			GroupTitle: vodCategories[string(vod.CategoryID)],
+			Extension:  vod.ContainerExtension,
+			TvgLogo:    vod.StreamIcon,
+			Plot:       vod.Plot,
+			Rating:     vod.Rating,
+			Year:       vod.Year,
+		}
+		if isValidStreamType(stream) {
+			streams = append(streams, stream)
+		} else {
+			logDebug(fmt.Sprintf("Rejected: %v", stream))
+			stats["rejectedFileExts"]++
+		}
+	}
+	logMessage(fmt.Sprintf("Xtream movies: %d", len(vods)))
+
+	// Series
+	seriesCategories, err := xtreamCategories(source, "get_series_categories")
+	if err != nil {
+		return nil, err
+	}
+	var series []xtreamSeries
+	if err := xtreamGet(source, "get_series", nil, &series); err != nil {
+		return nil, err
+	}
+	for _, show := range series {
+		if xtreamShowsOnly {
+			streams = append(streams, Stream{
+				TvgName:    show.Name,
+				GroupTitle: seriesCategories[string(show.CategoryID)],
+				SeriesName: show.Name,
+				TvgLogo:    show.Cover,
+				Year:       show.Year,
+			})
+			continue
+		}
+		logDebug(fmt.Sprintf("Fetching Xtream series info: %s", show.Name))
+		var info xtreamSeriesInfo
+		extra := url.Values{}
+		extra.Set("series_id", string(show.SeriesID))
+		if err := xtreamGet(source, "get_series_info", extra, &info); err != nil {
+			// One broken series should not abort the whole source
+			logError("Error fetching series info:", show.Name, err)
+			continue
+		}
+		for seasonKey, episodes := range info.Episodes {
+			for _, episode := range episodes {
+				season := episode.Season.Int()
+				if season == 0 {
+					season, _ = strconv.Atoi(seasonKey)
+				}
+				number := episode.EpisodeNum.Int()
+				info := episode.info()
+				stream := Stream{
+					URL:        fmt.Sprintf("%s/series/%s/%s/%s.%s", base, user, pass, episode.ID, episode.ContainerExtension),
+					TvgName:    fmt.Sprintf("%s S%02dE%02d", show.Name, season, number),
+					GroupTitle: seriesCategories[string(show.CategoryID)],
+					SeriesName: show.Name,
+					Season:     season,
+					Episode:    number,
+					Extension:  episode.ContainerExtension,
+					TvgLogo:    info.MovieImage,
+					Plot:       info.Plot,
+					Rating:     info.Rating,
+					Year:       show.Year,
+
+					SeriesPlot:   show.Plot,
+					SeriesPoster: show.Cover,
+				}
+				if isValidStreamType(stream) {
+					streams = append(streams, stream)
+				} else {
+					logDebug(fmt.Sprintf("Rejected: %v", stream))
+					stats["rejectedFileExts"]++
+				}
+			}
+		}
+	}
+	logMessage(fmt.Sprintf("Xtream series: %d", len(series)))
+
+	// Live channels, only read for the live TV playlist
+	if liveTV != nil && !xtreamShowsOnly {
+		liveCategories, err := xtreamCategories(source, "get_live_categories")
+		if err != nil {
+			return nil, err
+		}
+		var lives []xtreamLive
+		if err := xtreamGet(source, "get_live_streams", nil, &lives); err != nil {
+			return nil, err
+		}
+		for _, live := range lives {
+			collectLiveStream(Stream{
+				URL:        fmt.Sprintf("%s/live/%s/%s/%s.ts", base, user, pass, live.StreamID),
+				TvgName:    live.Name,
+				GroupTitle: liveCategories[string(live.CategoryID)],
+				Extension:  "ts",
+				TvgID:      live.EPGChannelID,
+				TvgLogo:    live.StreamIcon,
+				Attributes: map[string]string{"tvg-chno": string(live.Num)},
+			})
+		}
+		logMessage(fmt.Sprintf("Xtream live channels: %d", len(lives)))
+	}
+
+	// Save the collected streams locally in the jsonURLs format
+	body, err := json.MarshalIndent(streams, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error encoding xtream streams: %v", err)
+	}
+	filename := filepath.Join(downloadDir, fmt.Sprintf("GetSTRM_xtream_%d_%s.json", index, time.Now().Format("20060102_150405")))
+	if !dryRun {
+		err = ioutil.WriteFile(filename, body, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("error saving xtream file: %v", err)
+		}
+		logMessage(fmt.Sprintf("Saved Xtream file: %s", filename))
+	}
+
+	stats["processedXtream"]++
+	return streams, nil
+}
+
+// isValidStreamType checks the container extension reported by the source when
+// there is one, and falls back to the URL suffix otherwise.
+func isValidStreamType(stream Stream) bool {
+	if stream.Extension != "" {
+		return isValidStrmType("." + strings.TrimPrefix(stream.Extension, "."))
+	}
+	return isValidStrmType(stream.URL)
+}
+
+func isValidStrmType(url string) bool {
+	for _, ext := range fileTypes {
+		if strings.HasSuffix(strings.ToLower(url), strings.ToLower(ext)) {
+			return true
+		}
+	}
+	return false
+}
+
+// processTVShow writes the .strm file of an episode. With specials, a stream
+// without an episode number, such as a documentary in a tvshows library, is
+// filed as season 0 episode 1 of a show named after it instead of dropped.
+func processTVShow(stream Stream, tvShowsDir string, groupTitle string, episodeTemplate *template.Template, specials bool, keepFiles map[string]bool, stats map[string]int) {
+	data := pathData{
+		Group:    sanitizeFileName(groupTitle),
+		Name:     sanitizeFileName(normalizeName(stream.TvgName)),
+		Quality:  stream.Quality,
+		Codec:    stream.Codec,
+		Language: strings.Join(stream.Languages, " "),
+		Ext:      streamExt(stream),
+	}
+	if !isTVShow(stream) {
+		if !specials {
+			logError("Invalid TV show name format:", stream.TvgName)
+			return
+		}
+		title := normalizeName(stream.TvgName)
+		if namingStyle == namingJellyfin {
+			n := parseMediaName(stream.TvgName)
+			title, data.Year = n.Title, n.Year
+		}
+		data.Title = sanitizeFileName(title)
+		data.Season, data.Episode = 0, 1
+	} else if namingStyle == namingJellyfin {
+		n := episodeName(stream)
+		if !n.HasEpisode {
+			logError("Invalid TV show name format:", stream.TvgName)
+			return
+		}
+		data.Title = sanitizeFileName(n.Title)
+		data.Year, data.Season, data.Episode, data.LastEpisode = n.Year, n.Season, n.Episode, n.LastEpisode
+	} else if stream.SeriesName != "" {
+		// Series and season are known from the source, no need to guess
+		data.Title = sanitizeFileName(normalizeName(stream.SeriesName))
+		data.Season, data.Episode = stream.Season, stream.Episode
+	} else {
+		// Extract show name and season/episode info
+		m, ok := matchEpisode(stream.TvgName)
+		if !ok {
+			logError("Invalid TV show name format:", stream.TvgName)
+			return
+		}
+		// The show name is what comes before the season/episode
+		data.Title = sanitizeFileName(normalizeName(stream.TvgName[:m.Start]))
+		data.Season, data.Episode, data.LastEpisode = m.Season, m.Episode, m.LastEpisode
+	}
+
+	relPath, err := renderPath(episodeTemplate, data)
+	if err != nil {
+		logError("Error building path for", stream.TvgName, ":", err)
+		return
+	}
+	if stream.Version != "" {
+		relPath += " - " + stream.Version
+	}
+	strmFilePath := filepath.Join(tvShowsDir, relPath+".strm")
+
+	// Create directory structure
+	if !ensureDir(filepath.Dir(strmFilePath), stream.Source, stats) {
+		return
+	}
+
+	// Create or update .strm file
+	keepStrmFile(stream, strmFilePath, keepFiles, stats)
+
+	if writeNfo == 1 {
+		writeEpisodeSidecars(stream, strmFilePath, data.Title, keepFiles)
+	}
+}
+
+func processMovie(stream Stream, moviesDir string, groupTitle string, movieTemplate *template.Template, keepFiles map[string]bool, stats map[string]int) {
+	data := pathData{
+		Group:    sanitizeFileName(groupTitle),
+		Name:     sanitizeFileName(normalizeName(stream.TvgName)),
+		Title:    sanitizeFileName(normalizeName(stream.TvgName)),
+		Quality:  stream.Quality,
+		Codec:    stream.Codec,
+		Language: strings.Join(stream.Languages, " "),
+		Ext:      streamExt(stream),
+	}
+	if namingStyle == namingJellyfin {
+		n := parseMediaName(stream.TvgName)
+		data.Title, data.Year = sanitizeFileName(n.Title), n.Year
+	} else if movieVersions == versionsAll {
+		// The versions of a movie only group when they share a folder, so
+		// the quality, codec and language tags go from the legacy names
+		data.Name = sanitizeFileName(stripMediaTags(normalizeName(stream.TvgName)))
+		data.Title = data.Name
+	}
+
+	relPath, err := renderPath(movieTemplate, data)
+	if err != nil {
+		logError("Error building path for", stream.TvgName, ":", err)
+		return
+	}
+	if stream.Version != "" {
+		// Jellyfin and Emby group "Movie (2019) - 4K" with "Movie (2019)"
+		// and "Movie (2019) - FR"
+		relPath += " - " + stream.Version
+	}
+	strmFilePath := filepath.Join(moviesDir, relPath+".strm")
+
+	// Create directory structure
+	if !ensureDir(filepath.Dir(strmFilePath), stream.Source, stats) {
+		return
+	}
+
+	// Create or update .strm file
+	keepStrmFile(stream, strmFilePath, keepFiles, stats)
+
+	if writeNfo == 1 {
+		writeMovieSidecars(stream, strmFilePath, data.Title, keepFiles)
+	}
+}
+
+// Kodi/Jellyfin style .nfo documents
+type movieNfo struct {
+	XMLName xml.Name `xml:"movie"`
+	Title   string   `xml:"title"`
+	Year    int      `xml:"year,omitempty"`
+	Plot    string   `xml:"plot,omitempty"`
+	Rating  string   `xml:"rating,omitempty"`
+	Genre   string   `xml:"genre,omitempty"`
+	Thumb   string   `xml:"thumb,omitempty"`
+}
+
+type tvShowNfo struct {
+	XMLName xml.Name `xml:"tvshow"`
+	Title   string   `xml:"title"`
+	Year    int      `xml:"year,omitempty"`
+	Plot    string   `xml:"plot,omitempty"`
+	Genre   string   `xml:"genre,omitempty"`
+	Thumb   string   `xml:"thumb,omitempty"`
+}
+
+type episodeNfo struct {
+	XMLName   xml.Name `xml:"episodedetails"`
+	Title     string   `xml:"title"`
+	ShowTitle string   `xml:"showtitle"`
+	Season    int      `xml:"season"`
+	Episode   int      `xml:"episode"`
+	Plot      string   `xml:"plot,omitempty"`
+	Rating    string   `xml:"rating,omitempty"`
+	Thumb     string   `xml:"thumb,omitempty"`
+}
+
+// writeMovieSidecars writes movie.nfo and, when enabled, folder.jpg next to
+// the movie's .strm file. Movies sharing a folder, such as a letter bucket or
+// a flat layout, get <name>.nfo and <name>-poster.jpg instead.
+func writeMovieSidecars(stream Stream, strmFilePath, title string, keepFiles map[string]bool) {
+	n := parseMediaName(stream.TvgName)
+	if year := stream.Year.Int(); year > 0 {
+		n.Year = year
+	}
+	movieDir := filepath.Dir(strmFilePath)
+	nfoPath, posterPath := filepath.Join(movieDir, "movie.nfo"), filepath.Join(movieDir, "folder.jpg")
+	if !isTitleFolder(movieDir, title) {
+		base := strings.TrimSuffix(strmFilePath, ".strm")
+		nfoPath, posterPath = base+".nfo", base+"-poster.jpg"
+	}
+	writeNfoFile(nfoPath, movieNfo{
+		Title:  n.Title,
+		Year:   n.Year,
+		Plot:   stream.Plot,
+		Rating: string(stream.Rating),
+		Genre:  stream.GroupTitle,
+		Thumb:  stream.TvgLogo,
+	}, stream.Source, keepFiles)
+	if downloadPosters == 1 {
+		downloadPoster(stream.TvgLogo, posterPath, stream.Source, keepFiles)
+	}
+}
+
+// writeEpisodeSidecars writes the episode .nfo beside the .strm file and
+// tvshow.nfo/folder.jpg in the show folder. Shows without a folder of their
+// own only get the episode .nfo files, a shared tvshow.nfo would describe the
+// wrong show.
+func writeEpisodeSidecars(stream Stream, strmFilePath, title string, keepFiles map[string]bool) {
+	n := episodeName(stream)
+	if !n.HasEpisode {
+		n.Season, n.Episode = 0, 1 // filed as a special, see processTVShow
+	}
+	if year := stream.Year.Int(); year > 0 {
+		n.Year = year
+	}
+	writeNfoFile(strings.TrimSuffix(strmFilePath, ".strm")+".nfo", episodeNfo{
+		Title:     episodeTitle(stream.TvgName, n.Episode),
+		ShowTitle: n.Title,
+		Season:    n.Season,
+		Episode:   n.Episode,
+		Plot:      stream.Plot,
+		Rating:    string(stream.Rating),
+		Thumb:     stream.TvgLogo,
+	}, stream.Source, keepFiles)
+
+	showDir := showDirFor(strmFilePath)
+	if !isTitleFolder(showDir, title) {
+		return
+	}
+	writeNfoFile(filepath.Join(showDir, "tvshow.nfo"), tvShowNfo{
+		Title: n.Title,
+		Year:  n.Year,
+		Plot:  stream.SeriesPlot,
+		Genre: stream.GroupTitle,
+		Thumb: stream.SeriesPoster,
+	}, stream.Source, keepFiles)
+	if downloadPosters == 1 {
+		downloadPoster(stream.SeriesPoster, filepath.Join(showDir, "folder.jpg"), stream.Source, keepFiles)
+	}
+}
+
+// episodeTitle returns the text following the episode number in a name, or
+// "Episode N".
+func episodeTitle(name string, episode int) string {
+	if m, ok := matchEpisode(name); ok {
+		if title := strings.Trim(normalizeName(name[m.End:]), " -:"); title != "" {
+			return title
+		}
+	}
+	return fmt.Sprintf("Episode %d", episode)
+}
+
+// isTitleFolder reports whether dir belongs to title alone: it is named
+// "Title" or "Title (Year)" rather than after a group or a letter.
+func isTitleFolder(dir, title string) bool {
+	base, title := filepath.Base(dir), strings.TrimSpace(title)
+	return title != "" && (base == title || strings.HasPrefix(base, title+" ("))
+}
+
+var seasonDirRegex = regexp.MustCompile(`(?i)^(season\s*\d+|s\d+|specials)$`)
+
+// showDirFor returns the show folder of an episode: the parent of its season
+// folder, or the episode's own folder when there is no season level.
+func showDirFor(strmFilePath string) string {
+	dir := filepath.Dir(strmFilePath)
+	if seasonDirRegex.MatchString(filepath.Base(dir)) {
+		return filepath.Dir(dir)
+	}
+	return dir
+}
+
+// writeNfoFile writes an .nfo document when its content changed. Files that
+// exist but were not written by GetSTRM are treated as hand edited and kept.
+func writeNfoFile(filePath string, doc interface{}, source string, keepFiles map[string]bool) {
+	if keepFiles[filePath] {
+		return // already written for another episode of this show
+	}
+	if _, err := os.Stat(filePath); err == nil && !manifest.ownsFile(filePath) {
+		logDebug(fmt.Sprintf("Keeping hand made .nfo file: %s", filePath))
+		return
+	}
+	keepFiles[filePath] = true
+
+	body, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		logError("Error encoding .nfo file:", err)
+		return
+	}
+	data := append([]byte(xml.Header), body...)
+	if dryRun {
+		return
+	}
+	if existing, err := ioutil.ReadFile(filePath); err == nil && bytes.Equal(existing, data) {
+		return
+	}
+	if err := writeFileAtomic(filePath, data); err != nil {
+		logError("Error writing .nfo file:", err)
+		return
+	}
+	manifest.recordFile(source, filePath)
+}
+
+// downloadPoster saves the poster at imageURL as filePath once, existing
+// posters are not downloaded again.
+func downloadPoster(imageURL, filePath, source string, keepFiles map[string]bool) {
+	if imageURL == "" || keepFiles[filePath] {
+		return
+	}
+	if _, err := os.Stat(filePath); err == nil {
+		keepFiles[filePath] = true
+		return
+	}
+	keepFiles[filePath] = true
+	if dryRun {
+		return
+	}
+
+	f, err := fetcherFor(imageURL)
+	if err != nil {
+		logError("Error downloading poster:", err)
+		return
+	}
+	resp, err := f.get(imageURL, nil)
+	if err != nil {
+		logError("Error downloading poster:", imageURL, err)
+		return
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		logError("Error downloading poster:", err)
+		return
+	}
+	if err := writeFileAtomic(filePath, data); err != nil {
+		logError("Error writing poster:", err)
+		return
+	}
+	manifest.recordFile(source, filePath)
+}
+
+// pathData holds the variables available to movieTemplate and episodeTemplate.
+type pathData struct {
+	Group   string
+	Name    string // full tvg-name
+	Title   string
+	Year    int
+	Season  int
+	Episode int
+	// LastEpisode is the last episode of a multi-episode file, 0 otherwise
+	LastEpisode int
+	Quality     string
+	Codec       string
+	Language    string // language tags separated by spaces
+	Ext         string
+}
+
+// Built-in layouts, used when no movieTemplate/episodeTemplate is configured.
+const (
+	legacyMovieTemplate     = `{{.Name}}/{{.Name}}`
+	legacyEpisodeTemplate   = `{{.Title}}/S{{printf "%02d" .Season}}/{{.Name}}`
+	jellyfinMovieTemplate   = `{{.Title}}{{with .Year}} ({{.}}){{end}}/{{.Title}}{{with .Year}} ({{.}}){{end}}`
+	jellyfinEpisodeTemplate = `{{.Title}}{{with .Year}} ({{.}}){{end}}/Season {{printf "%02d" .Season}}/{{.Title}} S{{printf "%02d" .Season}}E{{printf "%02d" .Episode}}{{with .LastEpisode}}-E{{printf "%02d" .}}{{end}}`
+)
 
-		// Skip excluded groups
-		if contains(excludeGroups, groupTitle) {
-			logDebug(fmt.Sprintf("Excluding group: %s", groupTitle))
-			continue
+var templateFuncs = template.FuncMap{
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	// first returns the letter bucket for a title: "A".."Z" or "#"
+	"first": func(s string) string {
+		for _, r := range strings.ToUpper(s) {
+			if r >= 'A' && r <= 'Z' {
+				return string(r)
+			}
+			return "#"
 		}
+		return "#"
+	},
+}
 
-		// Include only specified groups
-		if len(includeGroups) > 0 && !contains(includeGroups, groupTitle) {
-			logDebug(fmt.Sprintf("Not in include group: %s", groupTitle))
-			continue
+// parsePathTemplate parses a path template, falling back to the built-in
+// layout for the naming style, and checks it stays below the output root.
+func parsePathTemplate(name, text, fallback string) (*template.Template, error) {
+	if strings.TrimSpace(text) == "" {
+		text = fallback
+		if useGroup == 1 {
+			text = "{{.Group}}/" + text
 		}
+	}
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	sample := pathData{Group: "Group", Name: "Name S01E01", Title: "Title", Year: 2000, Season: 1, Episode: 1, Quality: "1080p", Codec: "HEVC", Language: "MULTI-SUB", Ext: "mkv"}
+	if _, err := renderPath(tmpl, sample); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return tmpl, nil
+}
 
-		if tvShowRegex.MatchString(stream.TvgName) {
-			// It's a TV show
-			processTVShow(stream, tvShowsDir, groupTitle, tvShowRegex, keepFiles, stats)
-		} else {
-			// It's a movie
-			processMovie(stream, moviesDir, groupTitle, keepFiles, stats)
+// renderPath executes a path template and returns the relative .strm path
+// without extension. Empty segments are dropped and the result must not
+// escape the output root.
+func renderPath(tmpl *template.Template, data pathData) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	var segments []string
+	for _, segment := range strings.Split(filepath.ToSlash(b.String()), "/") {
+		if segment = strings.TrimSpace(segment); segment != "" {
+			segments = append(segments, segment)
 		}
 	}
+	relPath := filepath.Join(segments...)
+	if relPath == "" {
+		return "", fmt.Errorf("template produced an empty path")
+	}
+	if !filepath.IsLocal(relPath) {
+		return "", fmt.Errorf("path %q escapes the output directory", relPath)
+	}
+	return relPath, nil
+}
 
-	return stats
+var (
+	qualityRegex  = regexp.MustCompile(`(?i)\b(4K|UHD|2160p|FHD|1080p|HD|720p|SD|480p)\b`)
+	codecRegex    = regexp.MustCompile(`(?i)\b(HEVC|[HX]\.?265|AVC|[HX]\.?264|AV1)\b`)
+	languageRegex = regexp.MustCompile(`(?i)\b(MULTI[- ]?SUBS?|MULTI|VOSTFR|VOSTA|VOST|TRUEFRENCH|VFF|VFQ|VFI|VF|DUAL[- ]?AUDIO|SUBBED|DUBBED)\b`)
+	// brackets and bars left empty once the tags are removed
+	emptyTagRegex = regexp.MustCompile(`\[\s*\]|\(\s*\)|\|\s*\|`)
+)
+
+// setMediaTags fills the quality, codec and language tags of every stream
+// from its tvg-name.
+func setMediaTags(streams []Stream) {
+	for i := range streams {
+		streams[i].Quality = detectQuality(streams[i].TvgName)
+		streams[i].Codec = detectCodec(streams[i].TvgName)
+		streams[i].Languages = detectLanguages(streams[i].TvgName)
+	}
 }
 
-func contains(slice []string, item string) bool {
-	item = strings.ToLower(strings.TrimSpace(item))
-	for _, s := range slice {
-		logDebug(fmt.Sprintf("Checking if %s equals %s", strings.TrimSpace(s), item))
-		if strings.EqualFold(strings.TrimSpace(s), item) {
-			return true
+// stripMediaTags removes the quality, codec and language tags from a name,
+// along with the brackets and separators that only held them.
+func stripMediaTags(name string) string {
+	for _, re := range []*regexp.Regexp{qualityRegex, codecRegex, languageRegex} {
+		name = re.ReplaceAllString(name, " ")
+	}
+	for {
+		before := name
+		name = emptyTagRegex.ReplaceAllString(name, " ")
+		if name == before {
+			break
 		}
 	}
-	return false
+	return strings.Trim(spacesRegex.ReplaceAllString(name, " "), " -:|")
 }
 
-func removeEmptyDirs(rootDir string, stats map[string]int, limit int) {
-	// Create a case-insensitive map for keepFiles
-	ciKeepFiles := make(map[string]bool)
-	for k := range keepFiles {
-		ciKeepFiles[strings.ToLower(k)] = true
+// detectQuality returns the resolution tag found in a name, if any.
+func detectQuality(name string) string {
+	switch strings.ToUpper(qualityRegex.FindString(name)) {
+	case "4K", "UHD", "2160P":
+		return "4K"
+	case "FHD", "1080P":
+		return "1080p"
+	case "HD", "720P":
+		return "720p"
+	case "SD", "480P":
+		return "SD"
 	}
+	return ""
+}
 
-	deletions := 0
+// detectCodec returns the video codec found in a name, if any.
+func detectCodec(name string) string {
+	switch strings.ReplaceAll(strings.ToUpper(codecRegex.FindString(name)), ".", "") {
+	case "HEVC", "H265", "X265":
+		return "HEVC"
+	case "AVC", "H264", "X264":
+		return "H264"
+	case "AV1":
+		return "AV1"
+	}
+	return ""
+}
 
-	filepath.WalkDir(rootDir, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			logError("Error accessing path", path, ":", err)
-			return err
+// detectLanguages returns the language and subtitle tags found in a name,
+// upper cased with dashes: "multi sub" becomes MULTI-SUB.
+func detectLanguages(name string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, tag := range languageRegex.FindAllString(name, -1) {
+		tag = strings.ToUpper(strings.ReplaceAll(tag, " ", "-"))
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
 		}
-		if d.IsDir() {
-			// Remove files that are not in the ciKeepFiles map
-			files, err := ioutil.ReadDir(path)
-			if err != nil {
-				logError("Error reading directory:", err)
-				return err
-			}
-			for _, file := range files {
-				if deletions >= limit {
-					logMessage("Deletion limit reached.")
-					return filepath.SkipDir
-				}
+	}
+	return tags
+}
 
-				filePath := filepath.Join(path, file.Name())
-				if !file.IsDir() && filepath.Ext(file.Name()) == ".strm" {
-					// Convert filePath to lowercase for case-insensitive comparison
-					lowerCaseFilePath := strings.ToLower(filePath)
-					if !ciKeepFiles[lowerCaseFilePath] {
-						logMessage(fmt.Sprintf("Removing .strm file: %s", filePath))
-						if err := os.Remove(filePath); err != nil {
-							logError("Error removing file:", err)
-						} else {
-							removedStrmFiles++
-							stats["removedStrmFiles"]++
-							deletions++
-						}
-					} else {
-						logDebug(fmt.Sprintf("Keeping .strm file: %s", filePath))
-					}
-				}
-			}
+// streamExt returns the container extension of a stream without the dot.
+func streamExt(stream Stream) string {
+	if stream.Extension != "" {
+		return strings.TrimPrefix(stream.Extension, ".")
+	}
+	ext := path.Ext(stream.URL)
+	if i := strings.IndexAny(ext, "?#"); i >= 0 {
+		ext = ext[:i]
+	}
+	return strings.TrimPrefix(ext, ".")
+}
 
-			// Check if the directory is empty and remove it if it is
-			isEmpty, err := isDirEmpty(path)
-			if err != nil {
-				logError("Error checking directory:", err)
-				return err
-			}
-			if isEmpty && path != rootDir {
-				logMessage(fmt.Sprintf("Removing empty directory: %s", path))
-				if err := os.Remove(path); err != nil {
-					logError("Error removing directory:", err)
-				} else {
-					removedEmptyDirs++
-					stats["removedEmptyDirs"]++
-				}
-				return filepath.SkipDir // Skip further processing of this directory
-			}
-		}
-		return nil
-	})
+const (
+	namingLegacy   = "legacy"
+	namingJellyfin = "jellyfin"
+)
+
+var (
+	// "EN - ", "FR: ", "UK| " language prefixes. Only known codes are
+	// stripped and a dash needs a space next to it, so "MI-5" and "UP - ..."
+	// keep their names.
+	langPrefixRegex = regexp.MustCompile(`^(?:AL|AR|BG|BR|CN|CZ|DE|DK|EN|ES|FI|FR|GR|HE|HR|HU|IL|IR|IT|JP|KR|LAT|MK|NL|NO|PK|PL|PT|RO|RS|RU|SE|SK|SL|TR|UK|US|VN)(?:\s*[:|]\s*|\s+-\s*|\s*-\s+)`)
+	// "|4K|", "[EN]" provider tags
+	tagPrefixRegex  = regexp.MustCompile(`^(?:\|[^|]{1,12}\||\[[^\]]{1,12}\])\s*`)
+	yearParenRegex  = regexp.MustCompile(`\s*[(\[]((?:19|20)\d{2})[)\]]`)
+	yearSuffixRegex = regexp.MustCompile(`\s+((?:19|20)\d{2})$`)
+	spacesRegex     = regexp.MustCompile(`\s+`)
+)
+
+// mediaName is a title split into the parts Jellyfin and Emby scrapers match on.
+type mediaName struct {
+	Title       string
+	Year        int
+	Season      int
+	Episode     int
+	LastEpisode int
+	HasEpisode  bool
 }
 
-func isDirEmpty(dir string) (bool, error) {
-	logDebug(fmt.Sprintf("Checking if directory is empty: %s", dir))
-	f, err := os.Open(dir)
-	if err != nil {
-		return false, err
+// folderName returns "Title (Year)", or just the title when the year is unknown.
+func (n mediaName) folderName() string {
+	if n.Year == 0 {
+		return n.Title
 	}
-	defer f.Close()
+	return fmt.Sprintf("%s (%d)", n.Title, n.Year)
+}
 
-	_, err = f.Readdir(1)
-	if err == io.EOF {
-		return true, nil
-	}
-	return false, err
+// stripProviderPrefixes removes language and quality prefixes providers put in
+// front of titles, along with the configured stripPrefixes.
+func stripProviderPrefixes(title string) string {
+	title, _ = splitProviderPrefixes(title)
+	return title
 }
 
-func loadConfig(configFile string) (*Config, error) {
-	config := &Config{}
-	file, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		// Check if the file exists in the current working directory
-		if !filepath.IsAbs(configFile) {
-			currentDir, _ := os.Getwd()
-			configFile = filepath.Join(currentDir, configFile)
-			file, err = ioutil.ReadFile(configFile)
-			if err != nil {
-				return nil, err
+// splitProviderPrefixes strips the prefixes like stripProviderPrefixes and
+// also returns the code of the first language prefix, "EN" for "EN - Heat".
+func splitProviderPrefixes(title string) (string, string) {
+	var lang string
+	for {
+		before := title
+		title = strings.TrimSpace(title)
+		for _, prefix := range stripPrefixes {
+			prefix = strings.TrimSpace(prefix)
+			if prefix != "" && len(title) >= len(prefix) && strings.EqualFold(title[:len(prefix)], prefix) {
+				title = strings.TrimSpace(title[len(prefix):])
 			}
-		} else {
-			return nil, err
+		}
+		title = tagPrefixRegex.ReplaceAllString(title, "")
+		if m := langPrefixRegex.FindString(title); m != "" && lang == "" {
+			lang = strings.TrimRight(m, " :|-")
+		}
+		title = langPrefixRegex.ReplaceAllString(title, "")
+		if title == before {
+			return title, lang
 		}
 	}
-	err = json.Unmarshal(file, config)
-	if err != nil {
-		return nil, err
-	}
+}
 
-	// Trim spaces for excludeGroup and includeGroup
-	config.ExcludeGroup = strings.TrimSpace(config.ExcludeGroup)
-	config.IncludeGroup = strings.TrimSpace(config.IncludeGroup)
-	config.ExcludeGroup = strings.ReplaceAll(config.ExcludeGroup, ", ", ",")
-	config.IncludeGroup = strings.ReplaceAll(config.IncludeGroup, ", ", ",")
+// parseMediaName extracts title, year and season/episode from a provider name
+// such as "EN - Show Name (2019) S1E2" or "|4K| Movie Name 2019".
+func parseMediaName(raw string) mediaName {
+	var n mediaName
+	title := stripProviderPrefixes(stripMediaTags(normalizeName(raw)))
 
-	// Ensure proper trimming and splitting of excludeGroup and includeGroup
-	excludeGroups = filterEmptyStrings(strings.Split(strings.TrimSpace(config.ExcludeGroup), ","))
-	includeGroups = filterEmptyStrings(strings.Split(strings.TrimSpace(config.IncludeGroup), ","))
+	if m, ok := matchEpisode(title); ok {
+		n.Season, n.Episode, n.LastEpisode = m.Season, m.Episode, m.LastEpisode
+		n.HasEpisode = true
+		title = title[:m.Start]
+	}
 
-	// Check for any invalid keys in the JSON file
-	var raw map[string]interface{}
-	if err := json.Unmarshal(file, &raw); err != nil {
-		return nil, err
+	title, n.Year = extractYear(strings.TrimSpace(title))
+	n.Title = strings.TrimRight(spacesRegex.ReplaceAllString(strings.TrimSpace(title), " "), " -:")
+	if n.Title == "" {
+		n.Title = strings.TrimSpace(raw)
 	}
-	for key := range raw {
-		if _, ok := configMap[key]; !ok {
-			fmt.Printf("Warning: Unrecognized configuration key: %s\n", key)
+	return n
+}
+
+// extractYear removes a release year from title, preferring "(2019)" over a
+// trailing bare year. Years in the future are left alone ("Blade Runner 2049").
+func extractYear(title string) (string, int) {
+	maxYear := time.Now().Year() + 1
+	if m := yearParenRegex.FindStringSubmatchIndex(title); m != nil {
+		if year, _ := strconv.Atoi(title[m[2]:m[3]]); year <= maxYear {
+			return title[:m[0]] + title[m[1]:], year
 		}
 	}
-	return config, nil
+	if m := yearSuffixRegex.FindStringSubmatchIndex(title); m != nil && m[0] > 0 {
+		if year, _ := strconv.Atoi(title[m[2]:m[3]]); year <= maxYear {
+			return title[:m[0]], year
+		}
+	}
+	return title, 0
 }
 
-var configMap = map[string]struct{}{
-	"name":           {},
-	"logLevel":       {},
-	"tvShowsDir":     {},
-	"moviesDir":      {},
-	"jsonURLs":       {},
-	"m3uURLs":        {},
-	"logFile":        {},
-	"fileType":       {},
-	"workingDir":     {},
-	"logDir":         {},
-	"downloadDir":    {},
-	"retainDownload": {},
-	"useGroup":       {},
-	"defaultGroup":   {},
-	"limitDelete":    {},
-	"excludeGroup":   {},
-	"includeGroup":   {},
+// episodeName prefers the series, season and episode reported by the source
+// and falls back to parsing the tvg-name.
+func episodeName(stream Stream) mediaName {
+	n := parseMediaName(stream.TvgName)
+	if stream.SeriesName != "" {
+		series := parseMediaName(stream.SeriesName)
+		n.Title, n.Year = series.Title, series.Year
+		n.Season, n.Episode = stream.Season, stream.Episode
+		n.HasEpisode = true
+	}
+	return n
 }
 
-func saveConfigToFile(config *Config) error {
-	configPath := filepath.Join(workingDir, fmt.Sprintf("%s.json", config.Name))
-	configData, err := json.MarshalIndent(config, "", "  ")
-	if err != nil {
-		return err
+// ensureDir creates dir and records every level it created in the manifest.
+// It returns false when the directory could not be created.
+func ensureDir(dir, source string, stats map[string]int) bool {
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return true
 	}
-	return ioutil.WriteFile(configPath, configData, 0644)
+	// Every level MkdirAll creates, outermost first
+	missing := missingDirs(dir)
+	if !dryRun {
+		logMessage(fmt.Sprintf("Creating directory: %s", dir))
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			logError(fmt.Sprintf("Error creating directory: %s", dir), err)
+			return false
+		}
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if !dryRun {
+			manifest.recordDir(source, missing[i])
+		}
+		if plan.addCreatedDir(missing[i]) {
+			createdDirs++
+			stats["createdDirs"]++
+		}
+	}
+	return true
 }
 
-func processJSON(jsonURL string, index int) ([]Stream, error) {
-	// Download the JSON file
-	resp, err := http.Get(jsonURL)
-	if err != nil {
-		return nil, fmt.Errorf("error downloading json file: %v", err)
+func keepStrmFile(stream Stream, strmFilePath string, keepFiles map[string]bool, stats map[string]int) {
+	keepFiles[strmFilePath] = true
+	// Never take over a .strm file someone else put there
+	if _, err := os.Stat(strmFilePath); err == nil && !manifest.ownsFile(strmFilePath) {
+		logDebug(fmt.Sprintf("Not created by GetSTRM, leaving .strm file: %s", strmFilePath))
+		stats["foreignStrmFiles"]++
+		return
 	}
-	defer resp.Body.Close()
+	createOrUpdateStrmFile(strmFilePath, stream.URL, stats)
+	manifest.recordFile(stream.Source, strmFilePath)
+	keptStrmFiles++
+	stats["keptStrmFiles"]++
+	logDebug(fmt.Sprintf("Keep STRM File: %s", strmFilePath))
+}
 
-	// Read the JSON file
-	body, err := io.ReadAll(resp.Body)
+// strmFileState reports whether writing url to filePath would create a new
+// file, change an existing one or leave it unchanged.
+func strmFileState(filePath, url string) string {
+	existing, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		return nil, fmt.Errorf("error reading json file: %v", err)
+		return strmNew
 	}
-
-	// Save the JSON file locally
-	filename := filepath.Join(downloadDir, fmt.Sprintf("GetSTRM_%d_%s.json", index, time.Now().Format("20060102_150405")))
-	err = ioutil.WriteFile(filename, body, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("error saving json file: %v", err)
+	if string(existing) == url {
+		return strmUnchanged
 	}
-	logMessage(fmt.Sprintf("Saved JSON file: %s", filename))
+	return strmChanged
+}
 
-	// Parse the JSON data
-	var streams []Stream
-	err = json.Unmarshal(body, &streams)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing json file: %v", err)
+// createOrUpdateStrmFile only writes .strm files whose content changed, so
+// Emby/Jellyfin do not rescan files with a bumped mtime.
+func createOrUpdateStrmFile(filePath, url string, stats map[string]int) {
+	state := strmFileState(filePath, url)
+	switch state {
+	case strmNew:
+		stats["createdStrmFiles"]++
+	case strmChanged:
+		stats["updatedStrmFiles"]++
+	default:
+		stats["unchangedStrmFiles"]++
 	}
-
-	return streams, nil
+	if dryRun {
+		plan.addStrmFile(state, filePath)
+		return
+	}
+	if state == strmUnchanged {
+		logDebug(fmt.Sprintf("Unchanged .strm file: %s", filePath))
+		plan.addStrmFile(state, filePath)
+		return
+	}
+	if err := writeFileAtomic(filePath, []byte(url)); err != nil {
+		logError("Error writing .strm file:", err)
+		return
+	}
+	plan.addStrmFile(state, filePath)
 }
 
-func processM3U(m3uURL string, index int, stats map[string]int) ([]Stream, error) {
-	// Fetch the M3U file
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", m3uURL, nil)
+// writeFileAtomic writes data to a temporary file in the same directory and
+// renames it over filePath, so readers never see a partially written file.
+func writeFileAtomic(filePath string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".getstrm-*.tmp")
 	if err != nil {
-		return nil, fmt.Errorf("error creating request for m3u file: %v", err)
+		return err
 	}
-
-	// Set user agent to emulate a modern Chrome browser
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error downloading m3u file: %v", err)
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("error reading m3u file: %v", err)
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
 	}
-
-	// Save the M3U file locally
-	filename := filepath.Join(downloadDir, fmt.Sprintf("GetSTRM_%d_%s.m3u", index, time.Now().Format("20060102_150405")))
-	err = ioutil.WriteFile(filename, body, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("error saving m3u file: %v", err)
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
 	}
-	logMessage(fmt.Sprintf("Saved M3U file: %s", filename))
-
-	var streams []Stream
-	var currentStream *Stream
-
-	scanner := bufio.NewScanner(strings.NewReader(string(body)))
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "#EXTINF:") {
-			// Parse the metadata line
-			tvgName := parseTvgName(line)
-			groupTitle := parseGroupTitle(line)
-			currentStream = &Stream{
-				TvgName:    tvgName,
-				GroupTitle: groupTitle,
-			}
-		} else if currentStream != nil {
-			// This line contains the URL
-			currentStream.URL = line
-			if isValidStrmType(currentStream.URL) {
-				streams = append(streams, *currentStream)
-			} else {
-				logDebug(fmt.Sprintf("Rejected: %s", *currentStream))
-				stats["rejectedFileExts"]++
-			}
-			currentStream = nil
-		}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		os.Remove(tmp.Name())
+		return err
 	}
+	return nil
+}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading M3U file: %v", err)
-	}
+const (
+	strmNew       = "new"
+	strmChanged   = "changed"
+	strmUnchanged = "unchanged"
+)
 
-	return streams, nil
+// Plan collects what a run did to the output directories, or in a dry run
+// what it would do.
+type Plan struct {
+	CreatedDirs    []string `json:"createdDirs"`
+	NewFiles       []string `json:"newFiles"`
+	ChangedFiles   []string `json:"changedFiles"`
+	UnchangedFiles []string `json:"unchangedFiles"`
+	DeletedFiles   []string `json:"deletedFiles"`
+	RemovedDirs    []string `json:"removedDirs"`
+
+	createdDirs  map[string]bool
+	deletedFiles map[string]bool
 }
 
-func parseTvgName(line string) string {
-	re := regexp.MustCompile(`tvg-name="([^"]*)"`)
-	match := re.FindStringSubmatch(line)
-	if len(match) > 1 {
-		return match[1]
+func newPlan() *Plan {
+	return &Plan{
+		CreatedDirs:    []string{},
+		NewFiles:       []string{},
+		ChangedFiles:   []string{},
+		UnchangedFiles: []string{},
+		DeletedFiles:   []string{},
+		RemovedDirs:    []string{},
+		createdDirs:    make(map[string]bool),
+		deletedFiles:   make(map[string]bool),
 	}
-	return ""
 }
 
-func parseGroupTitle(line string) string {
-	re := regexp.MustCompile(`group-title="([^"]*)"`)
-	match := re.FindStringSubmatch(line)
-	if len(match) > 1 {
-		return match[1]
-	}
-	return ""
+func (p *Plan) addDeletedFile(filePath string) {
+	p.deletedFiles[filePath] = true
+	p.DeletedFiles = append(p.DeletedFiles, filePath)
 }
 
-func isValidStrmType(url string) bool {
-	for _, ext := range fileTypes {
-		if strings.HasSuffix(strings.ToLower(url), strings.ToLower(ext)) {
-			return true
-		}
+// addCreatedDir returns false when dir is already part of the plan.
+func (p *Plan) addCreatedDir(dir string) bool {
+	if p.createdDirs[dir] {
+		return false
 	}
-	return false
+	p.createdDirs[dir] = true
+	p.CreatedDirs = append(p.CreatedDirs, dir)
+	return true
 }
 
-func processTVShow(stream Stream, tvShowsDir string, groupTitle string, tvShowRegex *regexp.Regexp, keepFiles map[string]bool, stats map[string]int) {
-	// Extract show name and season/episode info
-	parts := tvShowRegex.FindString(stream.TvgName)
-	if parts == "" {
-		logError("Invalid TV show name format:", stream.TvgName)
-		return
+func (p *Plan) addStrmFile(state, filePath string) {
+	switch state {
+	case strmNew:
+		p.NewFiles = append(p.NewFiles, filePath)
+	case strmChanged:
+		p.ChangedFiles = append(p.ChangedFiles, filePath)
+	default:
+		p.UnchangedFiles = append(p.UnchangedFiles, filePath)
 	}
-	// Split the name and season/episode
-	showName := sanitizeFileName(normalizeName(strings.SplitN(stream.TvgName, parts, 2)[0]))
-	seasonEpisode := parts
-	season := seasonEpisode[:3] // Extract "Sxx"
+}
 
-	// Create directory structure
-	var showDir string
-	if useGroup == 1 {
-		showDir = filepath.Join(tvShowsDir, groupTitle, showName, season)
-	} else {
-		showDir = filepath.Join(tvShowsDir, showName, season)
+// isDirEmpty reports whether dir would be empty once the planned deletions
+// are applied.
+func (p *Plan) isDirEmpty(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
 	}
-	if _, err := os.Stat(showDir); os.IsNotExist(err) {
-		logMessage(fmt.Sprintf("Creating directory: %s", showDir))
-		err = os.MkdirAll(showDir, os.ModePerm)
-		if err != nil {
-			logError(fmt.Sprintf("Error creating directory: %s", showDir), err)
-			return
+	for _, e := range entries {
+		if !p.deletedFiles[filepath.Join(dir, e.Name())] {
+			return false, nil
 		}
-		createdDirs++
-		stats["createdDirs"]++
 	}
-
-	// Create or update .strm file
-	strmFilePath := filepath.Join(showDir, sanitizeFileName(normalizeName(stream.TvgName))+".strm")
-	keepFiles[strmFilePath] = true
-	createOrUpdateStrmFile(strmFilePath, stream.URL)
-	keptStrmFiles++
-	stats["keptStrmFiles"]++
-	logDebug(fmt.Sprintf("Keep STRM File: %s", strmFilePath))
+	return true, nil
 }
 
-func processMovie(stream Stream, moviesDir string, groupTitle string, keepFiles map[string]bool, stats map[string]int) {
-	// Create directory structure
-	var movieDir string
-	if useGroup == 1 {
-		movieDir = filepath.Join(moviesDir, groupTitle, sanitizeFileName(normalizeName(stream.TvgName)))
-	} else {
-		movieDir = filepath.Join(moviesDir, sanitizeFileName(normalizeName(stream.TvgName)))
-	}
-	if _, err := os.Stat(movieDir); os.IsNotExist(err) {
-		logMessage(fmt.Sprintf("Creating directory: %s", movieDir))
-		err = os.MkdirAll(movieDir, os.ModePerm)
-		if err != nil {
-			logError(fmt.Sprintf("Error creating directory: %s", movieDir), err)
-			return
+func printPlan(p *Plan) {
+	var b strings.Builder
+	section := func(title string, paths []string) {
+		fmt.Fprintf(&b, "%s: %d\n", title, len(paths))
+		for _, path := range paths {
+			fmt.Fprintf(&b, "  %s\n", path)
 		}
-		createdDirs++
-		stats["createdDirs"]++
 	}
-
-	// Create or update .strm file
-	strmFilePath := filepath.Join(movieDir, sanitizeFileName(normalizeName(stream.TvgName))+".strm")
-	keepFiles[strmFilePath] = true
-	createOrUpdateStrmFile(strmFilePath, stream.URL)
-	keptStrmFiles++
-	stats["keptStrmFiles"]++
-	logDebug(fmt.Sprintf("Keep STRM File: %s", strmFilePath))
+	b.WriteString("Dry run plan:\n")
+	section("Directories to create", p.CreatedDirs)
+	section("New .strm files", p.NewFiles)
+	section("Changed .strm files", p.ChangedFiles)
+	fmt.Fprintf(&b, "Unchanged .strm files: %d\n", len(p.UnchangedFiles))
+	section(".strm files to delete", p.DeletedFiles)
+	section("Directories to remove", p.RemovedDirs)
+	logMessage(b.String())
 }
 
-func createOrUpdateStrmFile(filePath, url string) {
-	file, err := os.Create(filePath)
+func writePlanJSON(p *Plan, path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
 	if err != nil {
-		logError("Error creating .strm file:", err)
-		return
+		return err
 	}
-	defer file.Close()
-
-	_, err = file.WriteString(url)
-	if err != nil {
-		logError("Error writing to .strm file:", err)
+	if path == "-" {
+		fmt.Println(string(data))
+		return nil
 	}
+	return ioutil.WriteFile(path, data, 0644)
 }
 
 func sanitizeFileName(name string) string {
@@ -837,8 +5720,8 @@ func normalizeName(name string) string {
 }
 
 func printStatistics(stats map[string]int) {
-	statMessage := fmt.Sprintf("Statistics:\nDirectories created: %d\n.strm files kept: %d\n.strm files removed: %d\nEmpty directories removed: %d\nProcessed JSON URLs: %d\nProcessed M3U URLs: %d\nRejected file extensions: %d\n",
-		stats["createdDirs"], stats["keptStrmFiles"], stats["removedStrmFiles"], stats["removedEmptyDirs"], stats["processedJsonURLs"], stats["processedM3UURLs"], stats["rejectedFileExts"])
+	statMessage := fmt.Sprintf("Statistics:\nDirectories created: %d\n.strm files kept: %d\n.strm files created: %d\n.strm files updated: %d\n.strm files unchanged: %d\n.strm files removed: %d\n.strm files not created by GetSTRM left alone: %d\nEmpty directories removed: %d\nProcessed JSON URLs: %d\nProcessed M3U URLs: %d\nProcessed Xtream sources: %d\nRejected file extensions: %d\nMalformed entries: %d\nUnchanged sources: %d\nDuplicate streams: %d\nLive channels: %d\nEPG programmes: %d\n",
+		stats["createdDirs"], stats["keptStrmFiles"], stats["createdStrmFiles"], stats["updatedStrmFiles"], stats["unchangedStrmFiles"], stats["removedStrmFiles"], stats["foreignStrmFiles"], stats["removedEmptyDirs"], stats["processedJsonURLs"], stats["processedM3UURLs"], stats["processedXtream"], stats["rejectedFileExts"], stats["malformedEntries"], stats["unchangedSources"], stats["duplicateStreams"], stats["liveChannels"], stats["epgProgrammes"])
 	logMessage(statMessage)
 }
 
@@ -854,9 +5737,12 @@ func logDebug(message string) {
 	}
 }
 
+// logOutput is where log messages are printed, next to the log file.
+var logOutput io.Writer = os.Stdout
+
 func logMessage(message string) {
 	timestampedMessage := fmt.Sprintf("%s %s", time.Now().Format(time.RFC3339), message)
-	fmt.Println(timestampedMessage) // Print to console
+	fmt.Fprintln(logOutput, timestampedMessage) // Print to console
 	if logFileHandle != nil {
 		logFileHandle.WriteString(timestampedMessage + "\n") // Write to log file
 	}
@@ -865,7 +5751,20 @@ func logMessage(message string) {
 func showHelp() {
 	fmt.Println(`
 
-Usage: GetSTRM [options]
+Usage: GetSTRM <command> [options]
+
+Commands:
+  sync              Fetch the sources and update the .strm tree (default when only options are given)
+  plan              Show what sync would create, update and delete without changing anything
+  validate-config   Check the configuration without fetching anything
+  groups            List every group title in the sources with its movie, series and rejected counts
+                    (-format table or json, -writeConfig file to write a starter config listing all groups)
+  init              Write a sample configuration (-output file, -force to overwrite)
+  restore           Put back the .strm files removed by a run: restore [-config file] [-list] <runID>
+  version           Display the version information
+
+Exit codes: 0 success, 1 the run or a source failed, 2 invalid command line or configuration
+
 Options:
   -config string
         Path to the configuration file
@@ -878,9 +5777,10 @@ Options:
   -moviesDir string
         Directory for movies (required)
   -jsonURL string
-        URL of the JSON file (can be specified multiple times, required if no m3uURLs)
+        URL or path of the JSON file, - for stdin (can be specified multiple times, required if no m3uURLs)
   -m3u string
-        URL of the M3U file (can be specified multiple times, required if no jsonURLs)
+        URL or path of the M3U file, - for stdin (can be specified multiple times, required if no jsonURLs)
+        gzip, xz and zip compressed playlists are detected automatically
   -logFile string
         Name of the log file (default: vod_log.txt)
   -fileType string
@@ -891,8 +5791,11 @@ Options:
         Directory for log files (default: workingDir/Log)
   -retainDownload int
         Set to 1 to keep downloaded files, 0 to delete (default: 0)
+        Kept files are reused when the provider reports the playlist has not changed
   -downloadDir string
         Directory to keep downloaded files (overrides default)
+  -skipUnchanged int
+        Set to 1 to skip the run when no source changed since the last run (default: 0)
   -limitDelete int
         Maximum number of .strm files to delete (default: 25)
   -useGroup int
@@ -903,14 +5806,64 @@ Options:
         Comma separated list of groups to exclude
   -includeGroup string
         Comma separated list of groups to include
+  -keepDuplicates int
+        Set to 1 to write every copy of a title listed in several groups or sources (default: 0)
+  -movieVersions string
+        best to keep the best copy of a movie, all to keep one file per quality (default: best)
+  -writeNfo int
+        Set to 1 to write movie.nfo, tvshow.nfo and episode .nfo files (default: 0)
+  -downloadPosters int
+        Set to 1 to download posters as folder.jpg when writeNfo is set (default: 0)
+  -naming string
+        Naming style: legacy or jellyfin (default: legacy)
+  -movieTemplate string
+        Go template for movie paths below moviesDir, e.g. "{{first .Title}}/{{.Title}}/{{.Title}}"
+  -episodeTemplate string
+        Go template for episode paths below tvShowsDir
+  -stripPrefixes string
+        Comma separated list of extra title prefixes to remove with jellyfin naming
+  -adoptExisting int
+        Set to 1 to take ownership of existing .strm files when no manifest exists yet (default: 0)
+  -maxDropPercent int
+        Skip pruning when a source lists this percentage fewer streams than last run (default: 50, 100 to disable)
+  -minStreams int
+        Skip pruning when a source lists fewer streams than this (default: 1, 0 to disable)
+  -forcePrune
+        Prune even when the prune guard detects a failed, empty or truncated source
+  -trashDays int
+        Days to keep removed .strm files in the trash, -1 to delete them at once (default: 30)
+  -daemon
+        Keep running and sync on the configured interval or schedule
+  -interval string
+        Time between daemon runs, e.g. 6h or 90m
+  -schedule string
+        Cron expression for daemon runs, e.g. "0 */4 * * *"
+  -jitter string
+        Random delay added to each daemon run, e.g. 10m
+  -logKeep int
+        Number of rotated log files to keep in daemon mode (default: 7)
+  -dryRun
+        Show what would be created, updated and deleted without changing anything
+  -planFile string
+        Write the dry run plan as JSON to this file, - for stdout
+  -timeout string
+        Download timeout for connecting and for each read, e.g. 60s (default: 60s)
+  -retries int
+        Number of retries for failed downloads, with exponential backoff (default: 3)
+  -userAgent string
+        User-Agent sent to providers (default: Chrome)
+  -proxy string
+        HTTP or SOCKS5 proxy URL, e.g. socks5://127.0.0.1:1080
   -version
         Display the version information
   -help
         Show help message
 
 Examples:
-  go run script_name.go -config "config.json"
-  go run script_name.go -name MyStreamApp -tvShowsDir /path/to/tvshows -moviesDir /path/to/movies -jsonURL http://example.com/file.json -logFile mylog.txt`)
+  GetSTRM sync -config "config.json"
+  GetSTRM plan -config "config.json" -planFile plan.json
+  GetSTRM groups -m3u http://example.com/playlist.m3u
+  GetSTRM sync -name MyStreamApp -tvShowsDir /path/to/tvshows -moviesDir /path/to/movies -jsonURL http://example.com/file.json -logFile mylog.txt`)
 }
 
 func filterEmptyStrings(slice []string) []string {
@@ -936,7 +5889,9 @@ func hasCommonElement(slice1, slice2 []string) bool {
 	return false
 }
 
-func createDefaultConfig() {
+// createDefaultConfig writes a sample configuration to configPath and creates
+// the directories it refers to below the current directory.
+func createDefaultConfig(configPath string) error {
 	workingDir, _ := os.Getwd()
 	tvShowsDir := filepath.Join(workingDir, "vod_tv")
 	moviesDir := filepath.Join(workingDir, "vod_movie")
@@ -972,27 +5927,26 @@ func createDefaultConfig() {
 		MoviesDir:      moviesDir,
 		JsonURLs:       []string{},
 		M3UURLs:        []string{},
+		XtreamSources:  []XtreamSource{},
+		MediaServers:   []MediaServer{},
 		LogFile:        "vod_log.txt",
 		FileType:       "avi,flv,m4v,mkv,mkv2,mkv5,mkvv,mp4,mp41,mp42,mp44,mpg,wmv",
 		WorkingDir:     workingDir,
 		LogDir:         logDir,
 		UseGroup:       0,
 		DefaultGroup:   "Dummy",
+		Naming:         namingLegacy,
 		ExcludeGroup:   "",
 		IncludeGroup:   "",
 	}
 
-	defaultConfigPath := "sample_config.json"
-	if _, err := os.Stat(defaultConfigPath); os.IsNotExist(err) {
-		configData, _ := json.MarshalIndent(defaultConfig, "", "  ")
-		ioutil.WriteFile(defaultConfigPath, configData, 0644)
-		fmt.Println("Default configuration created at sample_config.json")
+	configData, err := json.MarshalIndent(defaultConfig, "", "  ")
+	if err != nil {
+		return err
 	}
-}
-
-func init() {
-	// Only create a default config if no command line args or config file is provided
-	if len(os.Args) == 1 {
-		createDefaultConfig()
+	if err := ioutil.WriteFile(configPath, configData, 0644); err != nil {
+		return err
 	}
+	fmt.Println("Default configuration created at", configPath)
+	return nil
 }